@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"3.6/internal/database"
-	"3.6/internal/handlers"
-	"3.6/internal/middleware"
+	"3.7/internal/auth"
+	"3.7/internal/database"
+	"3.7/internal/export"
+	"3.7/internal/handlers"
+	"3.7/internal/middleware"
+	"3.7/internal/oidc"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -18,12 +21,31 @@ func main() {
 		log.Println("No .env file found")
 	}
 
+	// Ключи подписи токенов
+	if err := auth.InitKeys(); err != nil {
+		log.Fatal("Failed to load signing keys:", err)
+	}
+
+	// Шрифт PDF-отчетов (PDF_FONT_FILE)
+	if err := export.Init(); err != nil {
+		log.Fatal("Failed to load PDF font:", err)
+	}
+
 	// Инициализация БД
 	if err := database.Init(); err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 	defer database.Close()
 
+	// Вход через OpenID Connect (если задан OIDC_ISSUER); роли из
+	// OIDC_ROLE_MAPPING должны быть в таблице roles
+	if err := auth.LoadPermissions(); err != nil {
+		log.Fatal("Failed to load roles:", err)
+	}
+	if err := oidc.Init(auth.RoleExists); err != nil {
+		log.Fatal("Invalid OIDC configuration:", err)
+	}
+
 	// Создание маршрутов
 	router := gin.Default()
 
@@ -31,7 +53,8 @@ func main() {
 	router.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, If-Match, If-None-Match")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
@@ -42,21 +65,80 @@ func main() {
 	// Публичные маршруты
 	router.POST("/api/auth/login", handlers.Login)
 	router.POST("/api/auth/register", handlers.Register)
+	router.POST("/api/auth/refresh", handlers.Refresh)
+	router.POST("/api/auth/logout", handlers.Logout)
+	router.POST("/api/auth/2fa/setup", handlers.TwoFactorSetup)
+	router.POST("/api/auth/2fa/verify", handlers.TwoFactorVerify)
+	router.GET("/api/auth/oidc/login", handlers.OIDCLogin)
+	router.GET("/api/auth/oidc/callback", handlers.OIDCCallback)
+	router.GET("/.well-known/jwks.json", handlers.JWKS)
 
-	// Защищенные маршруты
-	api := router.Group("/api")
-	api.Use(middleware.AuthMiddleware())
+	// Защищенные маршруты: каждый обязан объявить требуемое право
+	api := middleware.Protected(router.Group("/api", middleware.AuthMiddleware()))
 	{
 		// Товары
-		api.GET("/items", handlers.GetItems)
-		api.POST("/items", handlers.CreateItem)
-		api.PUT("/items/:id", handlers.UpdateItem)
-		api.DELETE("/items/:id", handlers.DeleteItem)
+		api.GET("/items", "read", handlers.GetItems)
+		api.GET("/items/:id", "read", handlers.GetItem)
+		// Выгрузка текущих товаров (?format=csv|xlsx|jsonl|pdf)
+		api.GET("/items/export", "read", handlers.ExportInventory)
+		api.POST("/items", "create", handlers.CreateItem)
+		api.POST("/items/import", "import", handlers.ImportItems)
+		// Права create/update/delete проверяются по каждой операции пакета
+		api.POST("/items/batch", middleware.AnyUser, handlers.BatchItems)
+		api.PUT("/items/:id", "update", handlers.UpdateItem)
+		api.DELETE("/items/:id", "delete", handlers.DeleteItem)
+		// Движения остатков: приращения вместо перезаписи количества
+		api.POST("/items/:id/movements", "move_stock", handlers.CreateStockMovement)
+		api.GET("/items/:id/movements", "history", handlers.GetStockMovements)
 		// История
-		api.GET("/items/:id/history", handlers.GetItemHistory)
-		api.GET("/history/:history_id/diff", handlers.GetHistoryDiff)
-		// Экспорт истории (CSV)
-		api.GET("/items/:id/history/export", handlers.ExportHistory)
+		api.GET("/items/:id/history", "history", handlers.GetItemHistory)
+		// Состояние на момент времени
+		api.GET("/items/:id/as-of", "history", handlers.GetItemAsOf)
+		api.GET("/items/as-of", "history", handlers.GetInventoryAsOf)
+		api.GET("/history", "history", handlers.GetHistory)
+		api.GET("/history/stats", "history", handlers.GetHistoryStats)
+		api.GET("/history/search", "history", handlers.SearchHistory)
+		api.GET("/items/:id/diff", "history", handlers.GetItemDiff)
+		api.GET("/history/:history_id/diff", "history", handlers.GetHistoryDiff)
+		api.POST("/history/:history_id/revert", "revert", handlers.RevertChange)
+		// Пакеты изменений (импорт, пакетные операции, откаты)
+		api.GET("/batches/:id", "history", handlers.GetBatch)
+		api.POST("/batches/:id/revert", "revert", handlers.RevertBatch)
+		// Экспорт истории (?format=csv|xlsx|jsonl|pdf)
+		api.GET("/items/:id/history/export", "history", handlers.ExportHistory)
+		api.GET("/history/export", "history", handlers.ExportInventoryHistory)
+		// Роли и права
+		api.GET("/permissions", "manage_roles", handlers.GetPermissions)
+		api.GET("/roles", "manage_roles", handlers.GetRoles)
+		api.POST("/roles", "manage_roles", handlers.CreateRole)
+		api.PUT("/roles/:name", "manage_roles", handlers.UpdateRole)
+		api.DELETE("/roles/:name", "manage_roles", handlers.DeleteRole)
+		// Пользователи
+		api.GET("/users", "manage_users", handlers.GetUsers)
+		api.POST("/users", "manage_users", handlers.CreateUser)
+		api.PUT("/users/:username", "manage_users", handlers.UpdateUser)
+		api.DELETE("/users/:username", "manage_users", handlers.DeleteUser)
+		api.POST("/users/:username/unlock", "manage_users", handlers.UnlockUser)
+		api.GET("/users/:username/history", "manage_users", handlers.GetUserHistory)
+		// API-ключи
+		api.GET("/api-keys", "manage_api_keys", handlers.GetAPIKeys)
+		api.POST("/api-keys", "manage_api_keys", handlers.CreateAPIKey)
+		api.DELETE("/api-keys/:id", "manage_api_keys", handlers.RevokeAPIKey)
+		// Текущий пользователь
+		api.GET("/account", middleware.AnyUser, handlers.GetAccount)
+		// Двухфакторная аутентификация текущего пользователя
+		api.POST("/account/2fa/setup", middleware.AnyUser, handlers.SetupTwoFactor)
+		api.POST("/account/2fa/enable", middleware.AnyUser, handlers.EnableTwoFactor)
+		api.POST("/account/2fa/disable", middleware.AnyUser, handlers.DisableTwoFactor)
+		api.POST("/account/2fa/recovery-codes", middleware.AnyUser, handlers.RegenerateRecoveryCodes)
+		// Зоны локаций пользователей
+		api.GET("/users/:username/locations", "manage_users", handlers.GetUserLocations)
+		api.PUT("/users/:username/locations", "manage_users", handlers.SetUserLocations)
+	}
+
+	// Новый маршрут под /api без объявленного права не даст серверу запуститься
+	if err := middleware.VerifyRoutePermissions(router.Routes(), "/api/", "/api/auth/"); err != nil {
+		log.Fatal(err)
 	}
 
 	// Статические файлы для фронтенда
@@ -1,4 +1,5 @@
 let currentToken = null;
+let currentRefreshToken = null;
 let currentUser = null;
 
 // API Configuration
@@ -9,21 +10,29 @@ document.getElementById('loginForm').addEventListener('submit', async function(e
     e.preventDefault();
     
     const username = document.getElementById('username').value;
-    const role = document.getElementById('role').value;
+    const password = document.getElementById('password').value;
     
     try {
         const response = await fetch(`${API_BASE}/auth/login`, {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify({ username, role })
+            body: JSON.stringify({ username, password })
         });
         
+        if (response.status === 429) {
+            const retryAfter = response.headers.get('Retry-After');
+            throw new Error(`Too many failed attempts, try again in ${retryAfter} seconds`);
+        }
         if (!response.ok) {
-            throw new Error('Login failed');
+            throw new Error(response.status === 401 ? 'Invalid username or password' : 'Login failed');
         }
         
-        const data = await response.json();
+        let data = await response.json();
+        if (data.two_factor_required) {
+            data = await completeTwoFactor(data);
+        }
         currentToken = data.token;
+        currentRefreshToken = data.refresh_token;
         currentUser = data.user;
         
         // Update UI
@@ -31,7 +40,7 @@ document.getElementById('loginForm').addEventListener('submit', async function(e
             `${currentUser.username} (${currentUser.role})`;
         
         // Update permissions
-        updatePermissions(currentUser.role);
+        updatePermissions(currentUser.permissions || []);
         
         // Load items
         loadItems();
@@ -47,33 +56,99 @@ document.getElementById('loginForm').addEventListener('submit', async function(e
     }
 });
 
+// Second login step: TOTP code (with first-time setup when the role requires 2FA)
+async function completeTwoFactor(challengeData) {
+    const post = (path, body) => fetch(`${API_BASE}/auth/2fa/${path}`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body)
+    });
+    const challenge = challengeData.challenge;
+
+    if (challengeData.setup_required) {
+        const setup = await post('setup', { challenge });
+        if (!setup.ok) {
+            throw new Error('Two-factor setup failed');
+        }
+        const { secret, otpauth_uri } = await setup.json();
+        alert(`Two-factor authentication is required for your role.\n` +
+            `Add this key to your authenticator app:\n\n${secret}\n\n${otpauth_uri}`);
+    }
+
+    const code = prompt('Enter the 6-digit code from your authenticator app (or a recovery code)');
+    if (!code) {
+        throw new Error('Two-factor code required');
+    }
+    const body = /^\d{6}$/.test(code.trim()) ? { challenge, code } : { challenge, recovery_code: code };
+    const response = await post('verify', body);
+    if (!response.ok) {
+        throw new Error('Invalid two-factor code');
+    }
+
+    const data = await response.json();
+    if (data.recovery_codes) {
+        alert('Save your recovery codes:\n\n' + data.recovery_codes.join('\n'));
+    }
+    return data;
+}
+
+// Authorized request; on 401 tries to rotate the refresh token once
+async function apiFetch(url, options = {}) {
+    const withAuth = () => ({
+        ...options,
+        headers: { ...(options.headers || {}), 'Authorization': `Bearer ${currentToken}` }
+    });
+
+    let response = await fetch(url, withAuth());
+    if (response.status === 401 && currentRefreshToken) {
+        const refresh = await fetch(`${API_BASE}/auth/refresh`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ refresh_token: currentRefreshToken })
+        });
+        if (refresh.ok) {
+            const data = await refresh.json();
+            currentToken = data.token;
+            currentRefreshToken = data.refresh_token;
+            response = await fetch(url, withAuth());
+        }
+    }
+    return response;
+}
+
 // Update permissions display
-function updatePermissions(role) {
-    const permissions = {
-        admin: ['View items', 'Add items', 'Edit items', 'Delete items', 'View history', 'Export data'],
-        manager: ['View items', 'Add items', 'Edit items', 'View history'],
-        viewer: ['View items'],
-        auditor: ['View items', 'View history']
+function updatePermissions(permissions) {
+    const labels = {
+        read: 'View items',
+        create: 'Add items',
+        update: 'Edit items',
+        delete: 'Delete items',
+        history: 'View history',
+        manage_roles: 'Manage roles'
     };
     
     const list = document.getElementById('permissions-list');
     list.innerHTML = '';
     
-    permissions[role].forEach(perm => {
+    permissions.forEach(perm => {
         const li = document.createElement('li');
-        li.innerHTML = `<i class="bi bi-check-circle text-success"></i> ${perm}`;
+        li.innerHTML = `<i class="bi bi-check-circle text-success"></i> ${labels[perm] || perm}`;
         list.appendChild(li);
     });
     
-    // Show/hide buttons based on role
+    // Show/hide buttons based on permissions
     const addButton = document.getElementById('add-item-btn');
-    if (role === 'viewer') {
+    if (!permissions.includes('create')) {
         addButton.style.display = 'none';
     } else {
         addButton.style.display = 'block';
     }
 }
 
+function can(permission) {
+    return currentUser && (currentUser.permissions || []).includes(permission);
+}
+
 // Navigation
 function showSection(sectionId) {
     // Hide all sections
@@ -98,6 +173,11 @@ function showSection(sectionId) {
     }
 }
 
+// Items paging
+const ITEMS_PAGE_SIZE = 50;
+let itemsOffset = 0;
+let itemsTotal = 0;
+
 // Load items
 async function loadItems() {
     if (!currentToken) {
@@ -105,12 +185,17 @@ async function loadItems() {
         return;
     }
     
+    const params = new URLSearchParams({ limit: ITEMS_PAGE_SIZE, offset: itemsOffset });
+    const search = document.getElementById('items-search').value.trim();
+    const location = document.getElementById('items-location').value.trim();
+    const sort = document.getElementById('items-sort').value;
+    if (search) params.set('q', search);
+    if (location) params.set('location', location);
+    if (sort) params.set('sort', sort);
+    params.set('order', document.getElementById('items-order').value);
+    
     try {
-        const response = await fetch(`${API_BASE}/items`, {
-            headers: {
-                'Authorization': `Bearer ${currentToken}`
-            }
-        });
+        const response = await apiFetch(`${API_BASE}/items?${params}`);
         
         if (!response.ok) {
             if (response.status === 403) {
@@ -119,14 +204,35 @@ async function loadItems() {
             throw new Error('Failed to load items');
         }
         
-        const items = await response.json();
-        renderItems(items);
+        const page = await response.json();
+        itemsTotal = page.total;
+        renderItems(page.items);
+        renderItemsPager(page);
         
     } catch (error) {
         alert(error.message);
     }
 }
 
+// Render items paging controls
+function renderItemsPager(page) {
+    const first = page.total === 0 ? 0 : page.offset + 1;
+    const last = page.offset + page.items.length;
+    document.getElementById('items-page-info').textContent = `${first}-${last} of ${page.total}`;
+    document.getElementById('items-prev').disabled = page.offset === 0;
+    document.getElementById('items-next').disabled = last >= page.total;
+}
+
+// Move to the previous or next items page
+function changeItemsPage(direction) {
+    const offset = itemsOffset + direction * ITEMS_PAGE_SIZE;
+    if (offset < 0 || offset >= itemsTotal) {
+        return;
+    }
+    itemsOffset = offset;
+    loadItems();
+}
+
 // Render items table
 function renderItems(items) {
     const tbody = document.getElementById('items-table-body');
@@ -156,11 +262,11 @@ function renderItems(items) {
                     <i class="bi bi-clock-history"></i>
                 </button>
                 <button class="btn btn-sm btn-outline-warning me-1" onclick="showEditItemModal(${item.id})" 
-                    ${currentUser.role === 'viewer' ? 'disabled' : ''} title="Edit">
+                    ${!can('update') ? 'disabled' : ''} title="Edit">
                     <i class="bi bi-pencil"></i>
                 </button>
-                <button class="btn btn-sm btn-outline-danger" onclick="deleteItem(${item.id})" 
-                    ${currentUser.role !== 'admin' ? 'disabled' : ''} title="Delete">
+                <button class="btn btn-sm btn-outline-danger" onclick="deleteItem(${item.id}, ${item.version})" 
+                    ${!can('delete') ? 'disabled' : ''} title="Delete">
                     <i class="bi bi-trash"></i>
                 </button>
             </td>
@@ -185,12 +291,9 @@ async function addItem() {
     data.price = parseFloat(data.price);
     
     try {
-        const response = await fetch(`${API_BASE}/items`, {
+        const response = await apiFetch(`${API_BASE}/items`, {
             method: 'POST',
-            headers: {
-                'Authorization': `Bearer ${currentToken}`,
-                'Content-Type': 'application/json'
-            },
+            headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify(data)
         });
         
@@ -228,16 +331,18 @@ async function updateItem() {
         }
     });
     
+    data.version = editItemVersion;
+    
     try {
-        const response = await fetch(`${API_BASE}/items/${itemId}`, {
+        const response = await apiFetch(`${API_BASE}/items/${itemId}`, {
             method: 'PUT',
-            headers: {
-                'Authorization': `Bearer ${currentToken}`,
-                'Content-Type': 'application/json'
-            },
+            headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify(data)
         });
         
+        if (response.status === 409) {
+            throw new Error('This item was changed by someone else. Reopen it to see the current values.');
+        }
         if (!response.ok) {
             throw new Error('Failed to update item');
         }
@@ -253,19 +358,20 @@ async function updateItem() {
 }
 
 // Delete item
-async function deleteItem(itemId) {
+async function deleteItem(itemId, version) {
     if (!confirm('Are you sure you want to delete this item?')) {
         return;
     }
     
     try {
-        const response = await fetch(`${API_BASE}/items/${itemId}`, {
-            method: 'DELETE',
-            headers: {
-                'Authorization': `Bearer ${currentToken}`
-            }
+        const response = await apiFetch(`${API_BASE}/items/${itemId}?version=${version}`, {
+            method: 'DELETE'
         });
         
+        if (response.status === 409) {
+            loadItems();
+            throw new Error('This item was changed by someone else. The list has been refreshed.');
+        }
         if (!response.ok) {
             throw new Error('Failed to delete item');
         }
@@ -301,18 +407,14 @@ async function loadHistory() {
     if (action) url += `&action=${action}`;
     
     try {
-        const response = await fetch(url, {
-            headers: {
-                'Authorization': `Bearer ${currentToken}`
-            }
-        });
+        const response = await apiFetch(url);
         
         if (!response.ok) {
             throw new Error('Failed to load history');
         }
         
-        const history = await response.json();
-        renderHistory(history);
+        const page = await response.json();
+        renderHistory(page.history);
         
     } catch (error) {
         alert(error.message);
@@ -355,11 +457,7 @@ function renderHistory(history) {
 async function showHistoryDetails(historyId) {
     try {
         // Get history details
-        const response = await fetch(`${API_BASE}/history/${historyId}/diff`, {
-            headers: {
-                'Authorization': `Bearer ${currentToken}`
-            }
-        });
+        const response = await apiFetch(`${API_BASE}/history/${historyId}/diff`);
         
         if (!response.ok) {
             throw new Error('Failed to load history details');
@@ -369,14 +467,10 @@ async function showHistoryDetails(historyId) {
         
         // Get full history record
         const itemId = document.getElementById('history-item-id').value;
-        const historyResponse = await fetch(`${API_BASE}/items/${itemId}/history?limit=50`, {
-            headers: {
-                'Authorization': `Bearer ${currentToken}`
-            }
-        });
+        const historyResponse = await apiFetch(`${API_BASE}/items/${itemId}/history?limit=50`);
         
-        const history = await historyResponse.json();
-        const record = history.find(h => h.id === historyId);
+        const page = await historyResponse.json();
+        const record = page.history.find(h => h.id === historyId);
         
         // Populate modal
         document.getElementById('old-data').textContent = 
@@ -413,27 +507,38 @@ async function exportHistory() {
     }
     
     const itemId = document.getElementById('export-item-id').value;
-    if (!itemId) {
-        alert('Please enter an item ID');
+    const format = document.getElementById('export-format').value;
+    const path = itemId ? `/items/${itemId}/history/export` : '/history/export';
+    
+    await downloadExport(path, format, itemId ? `history_item_${itemId}.${format}` : `history.${format}`,
+        'Failed to export history');
+}
+
+// Export current items
+async function exportInventory() {
+    if (!currentToken) {
+        alert('Please login first');
         return;
     }
     
+    const format = document.getElementById('export-inventory-format').value;
+    await downloadExport('/items/export', format, `inventory.${format}`, 'Failed to export inventory');
+}
+
+async function downloadExport(path, format, filename, failure) {
     try {
-        const response = await fetch(`${API_BASE}/items/${itemId}/history/export`, {
-            headers: {
-                'Authorization': `Bearer ${currentToken}`
-            }
-        });
+        const response = await apiFetch(`${API_BASE}${path}?format=${format}`);
         
         if (!response.ok) {
-            throw new Error('Failed to export history');
+            const data = await response.json().catch(() => ({}));
+            throw new Error(data.error || failure);
         }
         
         const blob = await response.blob();
         const url = window.URL.createObjectURL(blob);
         const a = document.createElement('a');
         a.href = url;
-        a.download = `history_item_${itemId}.csv`;
+        a.download = filename;
         document.body.appendChild(a);
         a.click();
         window.URL.revokeObjectURL(url);
@@ -461,15 +566,71 @@ function showAddItemModal() {
     new bootstrap.Modal(document.getElementById('addItemModal')).show();
 }
 
-function showEditItemModal(itemId) {
-    // In a real app, you would fetch the item data first
-    document.getElementById('edit-item-id').value = itemId;
-    // Populate form with item data...
-    new bootstrap.Modal(document.getElementById('editItemModal')).show();
+// Version of the item open in the edit modal: the save is rejected if someone changed it meanwhile
+let editItemVersion = null;
+
+async function showEditItemModal(itemId) {
+    try {
+        const response = await apiFetch(`${API_BASE}/items/${itemId}`);
+        if (!response.ok) {
+            throw new Error('Failed to load item');
+        }
+        const item = await response.json();
+        editItemVersion = item.version;
+        
+        const form = document.getElementById('edit-item-form');
+        document.getElementById('edit-item-id').value = item.id;
+        ['name', 'description', 'quantity', 'price', 'location'].forEach(field => {
+            form.elements[field].value = item[field] ?? '';
+        });
+        new bootstrap.Modal(document.getElementById('editItemModal')).show();
+        
+    } catch (error) {
+        alert(error.message);
+    }
+}
+
+// Single sign-on: the backend redirects back with tokens in the URL fragment,
+// or with a two-factor challenge when the IdP did not verify a second factor
+async function completeSingleSignOn() {
+    const params = new URLSearchParams(window.location.hash.slice(1));
+    if (!params.get('token') && !params.get('challenge')) {
+        return;
+    }
+    history.replaceState(null, '', window.location.pathname);
+
+    try {
+        if (params.get('challenge')) {
+            const data = await completeTwoFactor({
+                challenge: params.get('challenge'),
+                setup_required: params.get('setup_required') === 'true'
+            });
+            currentToken = data.token;
+            currentRefreshToken = data.refresh_token;
+        } else {
+            currentToken = params.get('token');
+            currentRefreshToken = params.get('refresh_token');
+        }
+        const response = await apiFetch(`${API_BASE}/account`);
+        if (!response.ok) {
+            throw new Error('Failed to load account');
+        }
+        currentUser = await response.json();
+        document.getElementById('current-user').textContent =
+            `${currentUser.username} (${currentUser.role})`;
+        updatePermissions(currentUser.permissions || []);
+        loadItems();
+    } catch (error) {
+        currentToken = null;
+        currentRefreshToken = null;
+        alert('Single sign-on failed: ' + error.message);
+    }
 }
 
 // Initialize
 document.addEventListener('DOMContentLoaded', function() {
+    completeSingleSignOn();
+
     // Check if we have a saved token
     const savedToken = localStorage.getItem('token');
     if (savedToken) {
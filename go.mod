@@ -3,34 +3,42 @@ module 3.7
 go 1.25
 
 require (
-    github.com/gin-gonic/gin v1.9.1
-    github.com/golang-jwt/jwt/v5 v5.0.0
-    github.com/joho/godotenv v1.5.1
-    github.com/lib/pq v1.10.9
-    golang.org/x/crypto v0.14.0
+	github.com/gin-gonic/gin v1.9.1
+	github.com/go-pdf/fpdf v0.9.0
+	github.com/go-playground/validator/v10 v10.14.0
+	github.com/golang-jwt/jwt/v5 v5.0.0
+	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.10.9
+	github.com/xuri/excelize/v2 v2.8.1
+	golang.org/x/crypto v0.19.0
 )
 
 require (
-    github.com/bytedance/sonic v1.9.1 // indirect
-    github.com/chenzhuoyu/base64x v0.0.0-20221115062448-fe3a3abad311 // indirect
-    github.com/gabriel-vasile/mimetype v1.4.2 // indirect
-    github.com/gin-contrib/sse v0.1.0 // indirect
-    github.com/go-playground/locales v0.14.1 // indirect
-    github.com/go-playground/universal-translator v0.18.1 // indirect
-    github.com/go-playground/validator/v10 v10.14.0 // indirect
-    github.com/goccy/go-json v0.10.2 // indirect
-    github.com/json-iterator/go v1.1.12 // indirect
-    github.com/klauspost/cpuid/v2 v2.2.4 // indirect
-    github.com/leodido/go-urn v1.2.4 // indirect
-    github.com/mattn/go-isatty v0.0.19 // indirect
-    github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
-    github.com/modern-go/reflect2 v1.0.2 // indirect
-    github.com/pelletier/go-toml/v2 v2.0.8 // indirect
-    github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
-    github.com/ugorji/go/codec v1.2.11 // indirect
-    golang.org/x/arch v0.3.0 // indirect
-    golang.org/x/net v0.10.0 // indirect
-    golang.org/x/sys v0.13.0 // indirect
-    golang.org/x/text v0.13.0 // indirect
-    google.golang.org/protobuf v1.30.0 // indirect
+	github.com/bytedance/sonic v1.9.1 // indirect
+	github.com/chenzhuoyu/base64x v0.0.0-20221115062448-fe3a3abad311 // indirect
+	github.com/gabriel-vasile/mimetype v1.4.2 // indirect
+	github.com/gin-contrib/sse v0.1.0 // indirect
+	github.com/go-playground/locales v0.14.1 // indirect
+	github.com/go-playground/universal-translator v0.18.1 // indirect
+	github.com/goccy/go-json v0.10.2 // indirect
+	github.com/json-iterator/go v1.1.12 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.4 // indirect
+	github.com/leodido/go-urn v1.2.4 // indirect
+	github.com/mattn/go-isatty v0.0.19 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/mohae/deepcopy v0.0.0-20170929034955-c48cc78d4826 // indirect
+	github.com/pelletier/go-toml/v2 v2.0.8 // indirect
+	github.com/richardlehane/mscfb v1.0.4 // indirect
+	github.com/richardlehane/msoleps v1.0.3 // indirect
+	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
+	github.com/ugorji/go/codec v1.2.11 // indirect
+	github.com/xuri/efp v0.0.0-20231025114914-d1ff6096ae53 // indirect
+	github.com/xuri/nfp v0.0.0-20230919160717-d98342af3f05 // indirect
+	golang.org/x/arch v0.3.0 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/protobuf v1.30.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"3.7/internal/database"
+
+	"github.com/lib/pq"
+)
+
+// Префикс, по которому ключ отличается от JWT и находится в логах
+const apiKeyPrefix = "whk_"
+
+// APIKeyActions - права, которые можно выдать API-ключу.
+// Администрирование доступно только интерактивным пользователям.
+var APIKeyActions = []string{"create", "read", "update", "delete", "history", "import", "move_stock"}
+
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// IsAPIKeyAction проверяет, что право можно выдать API-ключу
+func IsAPIKeyAction(action string) bool {
+	for _, a := range APIKeyActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAPIKey отличает API-ключ от JWT по префиксу
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// NewAPIKey генерирует ключ; возвращает сам ключ, его видимый префикс и хеш
+func NewAPIKey() (key, prefix, hash string, err error) {
+	id, err := randomToken(6)
+	if err != nil {
+		return "", "", "", err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", "", "", err
+	}
+	prefix = apiKeyPrefix + id
+	key = prefix + "_" + secret
+	return key, prefix, HashToken(key), nil
+}
+
+// ValidateAPIKey находит действующий ключ, отмечает его использование
+// и возвращает claims владельца, ограниченные правами ключа
+func ValidateAPIKey(key string) (*Claims, error) {
+	claims := &Claims{}
+	err := database.DB.QueryRow(`
+		UPDATE api_keys k SET last_used_at = NOW()
+		FROM users u
+		WHERE u.username = k.username
+		  AND k.key_hash = $1
+		  AND k.revoked_at IS NULL
+		  AND (k.expires_at IS NULL OR k.expires_at > NOW())
+		  AND u.disabled_at IS NULL
+		RETURNING k.id, k.username, u.role, k.permissions
+	`, HashToken(key)).Scan(&claims.APIKeyID, &claims.Username, &claims.Role,
+		(*pq.StringArray)(&claims.Scopes))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claims.Scopes == nil {
+		claims.Scopes = []string{}
+	}
+	return claims, nil
+}
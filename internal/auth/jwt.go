@@ -9,33 +9,58 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtSecret = []byte("your-secret-key-change-in-production")
+// Время жизни access-токена; продлевается через refresh-токен
+const AccessTokenTTL = 15 * time.Minute
 
 type Claims struct {
-	Username string        `json:"username"`
-	Role     models.Role   `json:"role"`
+	Username  string      `json:"username"`
+	Role      models.Role `json:"role"`
+	SessionID string      `json:"sid"`
 	jwt.RegisteredClaims
+
+	// Заполняются только при аутентификации по API-ключу
+	APIKeyID int      `json:"-"`
+	Scopes   []string `json:"-"`
 }
 
-func GenerateToken(username string, role models.Role) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// Can проверяет право с учетом ограничений API-ключа
+func (c *Claims) Can(action string) bool {
+	if !HasPermission(c.Role, action) {
+		return false
+	}
+	if c.Scopes == nil {
+		return true
+	}
+	for _, scope := range c.Scopes {
+		if scope == action {
+			return true
+		}
+	}
+	return false
+}
+
+func GenerateToken(username string, role models.Role, sessionID string) (string, error) {
+	expirationTime := time.Now().Add(AccessTokenTTL)
 	claims := &Claims{
-		Username: username,
-		Role:     role,
+		Username:  username,
+		Role:      role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	if activeKey == nil {
+		return "", errors.New("signing keys are not initialized")
+	}
+	token := jwt.NewWithClaims(activeKey.Method, claims)
+	token.Header["kid"] = activeKey.ID
+	return token.SignedString(activeKey.Private)
 }
 
 func ValidateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, lookupKey)
 	if err != nil {
 		return nil, err
 	}
@@ -55,17 +80,7 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
+// HasPermission проверяет право роли по модели из таблиц roles/role_permissions
 func HasPermission(role models.Role, action string) bool {
-	permissions := map[models.Role][]string{
-		models.RoleAdmin:   {"create", "read", "update", "delete", "history"},
-		models.RoleManager: {"create", "read", "update", "history"},
-		models.RoleViewer:  {"read"},
-		models.RoleAuditor: {"read", "history"},
-	}
-	for _, perm := range permissions[role] {
-		if perm == action {
-			return true
-		}
-	}
-	return false
+	return rolePermissionSet(role)[action]
 }
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey - ключ подписи или проверки токенов с идентификатором kid
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private interface{} // []byte для HS256, *rsa.PrivateKey или ed25519.PrivateKey
+	Public  interface{} // []byte для HS256, *rsa.PublicKey или ed25519.PublicKey
+}
+
+var (
+	activeKey  *signingKey
+	verifyKeys = map[string]*signingKey{}
+)
+
+// InitKeys загружает ключи подписи из окружения:
+//
+//	JWT_KEY_ID           - kid активного ключа (по умолчанию "default")
+//	JWT_PRIVATE_KEY_FILE - PEM с приватным ключом RSA (RS256) или Ed25519 (EdDSA)
+//	JWT_SECRET           - общий секрет для HS256, если PEM-ключ не задан
+//	JWT_SECRET_FILE      - то же, но из файла
+//	JWT_VERIFY_KEYS      - "kid=path,kid=path" ключи, которые еще принимаются
+//	                       при ротации (PEM публичный/приватный ключ или секрет)
+//	JWT_EPHEMERAL_KEY    - "true": без ключа сгенерировать временный Ed25519-ключ
+//	                       (только для разработки: токены перестают действовать
+//	                       после перезапуска и не совпадают между экземплярами)
+//
+// Без ключа и без JWT_EPHEMERAL_KEY сервер не запускается.
+func InitKeys() error {
+	kid := os.Getenv("JWT_KEY_ID")
+	if kid == "" {
+		kid = "default"
+	}
+
+	var (
+		key *signingKey
+		err error
+	)
+	switch {
+	case os.Getenv("JWT_PRIVATE_KEY_FILE") != "":
+		key, err = loadKeyFile(kid, os.Getenv("JWT_PRIVATE_KEY_FILE"))
+	case os.Getenv("JWT_SECRET_FILE") != "":
+		key, err = loadKeyFile(kid, os.Getenv("JWT_SECRET_FILE"))
+	case os.Getenv("JWT_SECRET") != "":
+		key = hmacKey(kid, []byte(os.Getenv("JWT_SECRET")))
+	case os.Getenv("JWT_EPHEMERAL_KEY") == "true":
+		log.Println("JWT_EPHEMERAL_KEY is set, using an ephemeral Ed25519 key (development only)")
+		pub, priv, genErr := ed25519.GenerateKey(nil)
+		if genErr != nil {
+			return genErr
+		}
+		key = &signingKey{ID: kid, Method: jwt.SigningMethodEdDSA, Private: priv, Public: pub}
+	default:
+		return errors.New("no JWT signing key configured: set JWT_PRIVATE_KEY_FILE, JWT_SECRET_FILE " +
+			"or JWT_SECRET (JWT_EPHEMERAL_KEY=true allows a temporary key for development)")
+	}
+	if err != nil {
+		return err
+	}
+	if key.Private == nil {
+		return fmt.Errorf("signing key %q has no private part", kid)
+	}
+
+	keys := map[string]*signingKey{key.ID: key}
+	for _, entry := range strings.Split(os.Getenv("JWT_VERIFY_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid JWT_VERIFY_KEYS entry %q, expected kid=path", entry)
+		}
+		if _, exists := keys[parts[0]]; exists {
+			return fmt.Errorf("duplicate key id %q", parts[0])
+		}
+		k, err := loadKeyFile(parts[0], parts[1])
+		if err != nil {
+			return err
+		}
+		keys[k.ID] = k
+	}
+
+	activeKey = key
+	verifyKeys = keys
+	return nil
+}
+
+func hmacKey(kid string, secret []byte) *signingKey {
+	return &signingKey{ID: kid, Method: jwt.SigningMethodHS256, Private: secret, Public: secret}
+}
+
+// loadKeyFile разбирает PEM-ключ; файл без PEM-блока считается секретом HS256
+func loadKeyFile(kid, path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key %q: %w", kid, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		secret := []byte(strings.TrimSpace(string(data)))
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("key %q: empty secret", kid)
+		}
+		return hmacKey(kid, secret), nil
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("key %q: unsupported PEM block %q", kid, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse key %q: %w", kid, err)
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodRS256, Private: k, Public: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodRS256, Public: k}, nil
+	case ed25519.PrivateKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodEdDSA, Private: k, Public: k.Public()}, nil
+	case ed25519.PublicKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodEdDSA, Public: k}, nil
+	default:
+		return nil, fmt.Errorf("key %q: unsupported key type %T", kid, parsed)
+	}
+}
+
+// lookupKey используется при разборе токена: ключ выбирается по kid,
+// алгоритм токена обязан совпадать с алгоритмом ключа
+func lookupKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := verifyKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.Public, nil
+}
+
+// JWK - публичный ключ в формате RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS возвращает публичные части асимметричных ключей;
+// секреты HS256 никогда не публикуются
+func JWKS() []JWK {
+	keys := []JWK{}
+	for _, k := range verifyKeys {
+		jwk := JWK{Kid: k.ID, Alg: k.Method.Alg(), Use: "sig"}
+		switch pub := k.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return keys
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+	"3.7/internal/database"
+	"3.7/internal/models"
+)
+
+// Права ролей кешируются в памяти процесса. Кеш сбрасывается после
+// изменений через API и периодически перечитывается, чтобы правки,
+// сделанные на другом экземпляре сервиса, тоже вступали в силу.
+const permissionCacheTTL = time.Minute
+
+var permissionCache struct {
+	sync.RWMutex
+	roles     map[models.Role]map[string]bool
+	twoFactor map[models.Role]bool
+	loadedAt  time.Time
+}
+
+// LoadPermissions перечитывает права и политику 2FA всех ролей из БД
+func LoadPermissions() error {
+	rows, err := database.DB.Query(`
+		SELECT r.name, r.requires_2fa, rp.permission
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role = r.name
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	roles := map[models.Role]map[string]bool{}
+	twoFactor := map[models.Role]bool{}
+	for rows.Next() {
+		var (
+			role        models.Role
+			requires2FA bool
+			permission  *string
+		)
+		if err := rows.Scan(&role, &requires2FA, &permission); err != nil {
+			return err
+		}
+		if roles[role] == nil {
+			roles[role] = map[string]bool{}
+		}
+		twoFactor[role] = requires2FA
+		if permission != nil {
+			roles[role][*permission] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	permissionCache.Lock()
+	permissionCache.roles = roles
+	permissionCache.twoFactor = twoFactor
+	permissionCache.loadedAt = time.Now()
+	permissionCache.Unlock()
+	return nil
+}
+
+// InvalidatePermissions сбрасывает кеш; следующая проверка загрузит права заново
+func InvalidatePermissions() {
+	permissionCache.Lock()
+	permissionCache.roles = nil
+	permissionCache.Unlock()
+}
+
+func cachedRoles() (map[models.Role]map[string]bool, map[models.Role]bool) {
+	permissionCache.RLock()
+	roles, twoFactor, loadedAt := permissionCache.roles, permissionCache.twoFactor, permissionCache.loadedAt
+	permissionCache.RUnlock()
+
+	if roles == nil || time.Since(loadedAt) > permissionCacheTTL {
+		if err := LoadPermissions(); err != nil {
+			log.Printf("Failed to load permissions: %v", err)
+			return roles, twoFactor
+		}
+		permissionCache.RLock()
+		roles, twoFactor = permissionCache.roles, permissionCache.twoFactor
+		permissionCache.RUnlock()
+	}
+	return roles, twoFactor
+}
+
+func rolePermissionSet(role models.Role) map[string]bool {
+	roles, _ := cachedRoles()
+	return roles[role]
+}
+
+// RoleExists сообщает, есть ли роль в таблице roles
+func RoleExists(role models.Role) bool {
+	roles, _ := cachedRoles()
+	_, ok := roles[role]
+	return ok
+}
+
+// RequiresTwoFactor сообщает, обязателен ли второй фактор для роли.
+// Если политику не удалось загрузить, второй фактор считается обязательным.
+func RequiresTwoFactor(role models.Role) bool {
+	_, twoFactor := cachedRoles()
+	if twoFactor == nil {
+		return true
+	}
+	return twoFactor[role]
+}
+
+// RolePermissions возвращает отсортированный список прав роли
+func RolePermissions(role models.Role) []string {
+	perms := []string{}
+	for perm := range rolePermissionSet(role) {
+		perms = append(perms, perm)
+	}
+	sort.Strings(perms)
+	return perms
+}
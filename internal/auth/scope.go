@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"3.7/internal/database"
+	"3.7/internal/models"
+
+	"github.com/lib/pq"
+)
+
+// LocationScope - набор локаций, с которыми может работать пользователь.
+// Пустой набор означает отсутствие ограничений.
+type LocationScope struct {
+	Exact    []string
+	Prefixes []string
+}
+
+// LoadLocationScope читает зоны пользователя из user_location_scopes
+func LoadLocationScope(username string) (*LocationScope, error) {
+	rows, err := database.DB.Query(`
+		SELECT location, is_prefix FROM user_location_scopes WHERE username = $1
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scope := &LocationScope{}
+	for rows.Next() {
+		var rule models.LocationRule
+		if err := rows.Scan(&rule.Location, &rule.IsPrefix); err != nil {
+			return nil, err
+		}
+		if rule.IsPrefix {
+			scope.Prefixes = append(scope.Prefixes, rule.Location)
+		} else {
+			scope.Exact = append(scope.Exact, rule.Location)
+		}
+	}
+	return scope, rows.Err()
+}
+
+// Unrestricted сообщает, что пользователю доступны все локации
+func (s *LocationScope) Unrestricted() bool {
+	return len(s.Exact) == 0 && len(s.Prefixes) == 0
+}
+
+// Allows проверяет, входит ли локация в зону пользователя
+func (s *LocationScope) Allows(location string) bool {
+	if s.Unrestricted() {
+		return true
+	}
+	for _, l := range s.Exact {
+		if l == location {
+			return true
+		}
+	}
+	for _, p := range s.Prefixes {
+		if strings.HasPrefix(location, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Condition возвращает SQL-фрагмент " AND (...)" для фильтрации по выражению
+// с локацией и аргументы для него, нумеруя плейсхолдеры с argCount.
+// Для неограниченного пользователя фрагмент пустой.
+func (s *LocationScope) Condition(expr string, argCount int) (string, []interface{}) {
+	if s.Unrestricted() {
+		return "", nil
+	}
+
+	patterns := make([]string, len(s.Prefixes))
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	for i, p := range s.Prefixes {
+		patterns[i] = escaper.Replace(p) + "%"
+	}
+
+	cond := fmt.Sprintf(" AND (%s = ANY($%d::text[]) OR %s LIKE ANY($%d::text[]))",
+		expr, argCount, expr, argCount+1)
+	return cond, []interface{}{pq.Array(s.Exact), pq.Array(patterns)}
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+	"3.7/internal/database"
+	"3.7/internal/models"
+)
+
+// Время жизни refresh-токена
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// Session описывает результат выдачи или ротации refresh-токена
+type Session struct {
+	ID           string
+	Username     string
+	Role         models.Role
+	RefreshToken string
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken возвращает SHA-256 хеш токена в hex для хранения в БД
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func insertRefreshToken(tx *sql.Tx, sessionID string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (token_hash, session_id, expires_at)
+		VALUES ($1, $2, NOW() + $3::int * INTERVAL '1 second')
+	`, HashToken(token), sessionID, int(RefreshTokenTTL.Seconds()))
+	return token, err
+}
+
+// CreateSession открывает новую сессию и выдает первый refresh-токен
+func CreateSession(username string, role models.Role) (*Session, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO sessions (id, username) VALUES ($1, $2)`, sessionID, username); err != nil {
+		return nil, err
+	}
+	token, err := insertRefreshToken(tx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &Session{ID: sessionID, Username: username, Role: role, RefreshToken: token}, nil
+}
+
+// RotateRefreshToken гасит предъявленный refresh-токен и выдает новый.
+// Повторное предъявление уже использованного токена отзывает всю сессию.
+func RotateRefreshToken(refreshToken string) (*Session, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		session    Session
+		expired    bool
+		usedAt     sql.NullTime
+		revokedAt  sql.NullTime
+		disabledAt sql.NullTime
+	)
+	err = tx.QueryRow(`
+		SELECT s.id, s.username, u.role, t.expires_at < NOW(), t.used_at, s.revoked_at, u.disabled_at
+		FROM refresh_tokens t
+		JOIN sessions s ON s.id = t.session_id
+		JOIN users u ON u.username = s.username
+		WHERE t.token_hash = $1
+		FOR UPDATE OF t, s
+	`, HashToken(refreshToken)).Scan(&session.ID, &session.Username, &session.Role,
+		&expired, &usedAt, &revokedAt, &disabledAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedAt.Valid || disabledAt.Valid || expired {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if usedAt.Valid {
+		if _, err := tx.Exec(`UPDATE sessions SET revoked_at = NOW() WHERE id = $1`, session.ID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = NOW() WHERE token_hash = $1`,
+		HashToken(refreshToken)); err != nil {
+		return nil, err
+	}
+	session.RefreshToken, err = insertRefreshToken(tx, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// RevokeSessionByRefreshToken отзывает сессию, которой принадлежит refresh-токен
+func RevokeSessionByRefreshToken(refreshToken string) error {
+	result, err := database.DB.Exec(`
+		UPDATE sessions SET revoked_at = NOW()
+		WHERE revoked_at IS NULL
+		  AND id = (SELECT session_id FROM refresh_tokens WHERE token_hash = $1)
+	`, HashToken(refreshToken))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrInvalidRefreshToken
+	}
+	return nil
+}
+
+// RevokeUserSessions отзывает все активные сессии пользователя
+func RevokeUserSessions(username string) error {
+	_, err := database.DB.Exec(`
+		UPDATE sessions SET revoked_at = NOW()
+		WHERE username = $1 AND revoked_at IS NULL
+	`, username)
+	return err
+}
+
+// IsSessionActive проверяет, что сессия access-токена не отозвана,
+// а ее владелец не отключен
+func IsSessionActive(sessionID string) (bool, error) {
+	var active bool
+	err := database.DB.QueryRow(`
+		SELECT s.revoked_at IS NULL AND u.disabled_at IS NULL
+		FROM sessions s
+		JOIN users u ON u.username = s.username
+		WHERE s.id = $1
+	`, sessionID).Scan(&active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return active, err
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+	"3.7/internal/database"
+)
+
+// Время на возврат пользователя с IdP
+const OIDCStateTTL = 10 * time.Minute
+
+// Хеш пароля учетных записей SSO: не совпадает ни с одним bcrypt-хешем,
+// поэтому локальный вход для них невозможен
+const NoPasswordHash = "!"
+
+var ErrInvalidOIDCState = errors.New("invalid or expired login state")
+
+// OIDCState - параметры запроса авторизации, которые нужны в callback
+type OIDCState struct {
+	CodeVerifier string
+	Nonce        string
+}
+
+// CreateOIDCState сохраняет PKCE verifier и nonce, возвращает значение state
+func CreateOIDCState(s OIDCState) (string, error) {
+	state, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = database.DB.Exec(`
+		INSERT INTO oidc_login_states (state_hash, code_verifier, nonce, expires_at)
+		VALUES ($1, $2, $3, NOW() + $4::int * INTERVAL '1 second')
+	`, HashToken(state), s.CodeVerifier, s.Nonce, int(OIDCStateTTL.Seconds()))
+	return state, err
+}
+
+// ConsumeOIDCState одноразово забирает состояние по значению state
+func ConsumeOIDCState(state string) (*OIDCState, error) {
+	var s OIDCState
+	err := database.DB.QueryRow(`
+		DELETE FROM oidc_login_states
+		WHERE state_hash = $1 AND expires_at > NOW()
+		RETURNING code_verifier, nonce
+	`, HashToken(state)).Scan(&s.CodeVerifier, &s.Nonce)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidOIDCState
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Заодно чистим брошенные попытки входа
+	database.DB.Exec(`DELETE FROM oidc_login_states WHERE expires_at <= NOW()`)
+	return &s, nil
+}
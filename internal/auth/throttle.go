@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"database/sql"
+	"math"
+	"time"
+	"3.7/internal/database"
+)
+
+// Политика защиты от подбора пароля
+const (
+	// Сколько неудач подряд прощается до начала задержек
+	userFreeFailures = 3
+	ipFreeFailures   = 20
+	// Базовая задержка, удваивается с каждой следующей неудачей
+	throttleBaseDelay = time.Second
+	userMaxDelay      = 15 * time.Minute
+	ipMaxDelay        = time.Hour
+	// После стольких неудач учетная запись блокируется целиком
+	lockoutThreshold = 10
+	lockoutDuration  = 30 * time.Minute
+	// Счетчик сбрасывается, если неудач не было дольше этого окна
+	throttleWindow = time.Hour
+)
+
+// CheckLogin возвращает, сколько еще нужно ждать до следующей попытки
+// входа для логина и IP; ноль означает, что попытка разрешена
+func CheckLogin(username, ip string) (time.Duration, error) {
+	var seconds float64
+	err := database.DB.QueryRow(`
+		SELECT COALESCE(EXTRACT(EPOCH FROM GREATEST(
+			(SELECT blocked_until FROM login_throttle WHERE scope = 'user' AND key = $1),
+			(SELECT blocked_until FROM login_throttle WHERE scope = 'ip' AND key = $2),
+			(SELECT locked_until FROM users WHERE username = $1)
+		) - NOW()), 0)
+	`, username, ip).Scan(&seconds)
+	if err != nil || seconds <= 0 {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// RecordLoginFailure учитывает неудачную попытку и возвращает задержку
+// до следующей разрешенной попытки
+func RecordLoginFailure(username, ip string) (time.Duration, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	userWait, userFailures, err := recordFailure(tx, "user", username, userFreeFailures, userMaxDelay)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, _, err := recordFailure(tx, "ip", ip, ipFreeFailures, ipMaxDelay)
+	if err != nil {
+		return 0, err
+	}
+
+	wait := userWait
+	if ipWait > wait {
+		wait = ipWait
+	}
+	if userFailures >= lockoutThreshold {
+		_, err := tx.Exec(`
+			UPDATE users SET locked_until = NOW() + $2::int * INTERVAL '1 second'
+			WHERE username = $1
+		`, username, int(lockoutDuration.Seconds()))
+		if err != nil {
+			return 0, err
+		}
+		if lockoutDuration > wait {
+			wait = lockoutDuration
+		}
+	}
+
+	return wait, tx.Commit()
+}
+
+func recordFailure(tx *sql.Tx, scope, key string, free int, maxDelay time.Duration) (time.Duration, int, error) {
+	var failures int
+	err := tx.QueryRow(`
+		INSERT INTO login_throttle (scope, key, failures, last_failure_at)
+		VALUES ($1, $2, 1, NOW())
+		ON CONFLICT (scope, key) DO UPDATE SET
+			failures = CASE
+				WHEN login_throttle.last_failure_at < NOW() - $3::int * INTERVAL '1 second' THEN 1
+				ELSE login_throttle.failures + 1
+			END,
+			last_failure_at = NOW()
+		RETURNING failures
+	`, scope, key, int(throttleWindow.Seconds())).Scan(&failures)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	wait := backoff(failures, free, maxDelay)
+	if wait > 0 {
+		_, err := tx.Exec(`
+			UPDATE login_throttle SET blocked_until = NOW() + $3::bigint * INTERVAL '1 millisecond'
+			WHERE scope = $1 AND key = $2
+		`, scope, key, wait.Milliseconds())
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return wait, failures, nil
+}
+
+// backoff - экспоненциальная задержка после free бесплатных неудач
+func backoff(failures, free int, maxDelay time.Duration) time.Duration {
+	if failures <= free {
+		return 0
+	}
+	delay := float64(throttleBaseDelay) * math.Pow(2, float64(failures-free-1))
+	if delay > float64(maxDelay) {
+		return maxDelay
+	}
+	return time.Duration(delay)
+}
+
+// RecordLoginSuccess сбрасывает счетчик неудач логина.
+// Счетчик IP сбрасывается только по времени, иначе атакующий мог бы
+// обнулять его, входя под собственной учетной записью.
+func RecordLoginSuccess(username string) error {
+	_, err := database.DB.Exec(`DELETE FROM login_throttle WHERE scope = 'user' AND key = $1`, username)
+	return err
+}
+
+// UnlockUser снимает блокировку учетной записи и ее счетчик неудач
+func UnlockUser(tx *sql.Tx, username string) error {
+	if _, err := tx.Exec(`UPDATE users SET locked_until = NULL WHERE username = $1`, username); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM login_throttle WHERE scope = 'user' AND key = $1`, username)
+	return err
+}
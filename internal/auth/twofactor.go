@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+	"3.7/internal/database"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// Название сервиса в приложении-аутентификаторе
+	totpIssuer = "Warehouse"
+	// Время на ввод второго фактора после пароля
+	LoginChallengeTTL     = 5 * time.Minute
+	loginChallengeTries   = 5
+	recoveryCodesPerIssue = 10
+)
+
+// Назначение промежуточного входа
+const (
+	ChallengeVerify = "verify" // у пользователя включен TOTP, нужен код
+	ChallengeEnroll = "enroll" // роль требует 2FA, а TOTP еще не настроен
+)
+
+var (
+	ErrInvalidChallenge    = errors.New("invalid or expired login challenge")
+	ErrInvalidTOTPCode     = errors.New("invalid two-factor code")
+	ErrNoPendingEnrollment = errors.New("two-factor setup has not been started")
+)
+
+// LoginChallenge - пароль проверен, ожидается второй фактор
+type LoginChallenge struct {
+	Username string
+	Purpose  string
+}
+
+// CreateLoginChallenge выдает одноразовый токен промежуточного входа
+func CreateLoginChallenge(username, purpose string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = database.DB.Exec(`
+		INSERT INTO login_challenges (token_hash, username, purpose, expires_at)
+		VALUES ($1, $2, $3, NOW() + $4::int * INTERVAL '1 second')
+	`, HashToken(token), username, purpose, int(LoginChallengeTTL.Seconds()))
+	return token, err
+}
+
+// UseLoginChallenge засчитывает попытку по токену и возвращает его данные;
+// после исчерпания попыток или истечения срока токен недействителен
+func UseLoginChallenge(token string) (*LoginChallenge, error) {
+	var ch LoginChallenge
+	err := database.DB.QueryRow(`
+		UPDATE login_challenges SET attempts = attempts + 1
+		WHERE token_hash = $1 AND expires_at > NOW() AND attempts < $2
+		RETURNING username, purpose
+	`, HashToken(token), loginChallengeTries).Scan(&ch.Username, &ch.Purpose)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// DeleteLoginChallenge гасит токен после успешного входа
+func DeleteLoginChallenge(token string) error {
+	_, err := database.DB.Exec(`DELETE FROM login_challenges WHERE token_hash = $1`, HashToken(token))
+	return err
+}
+
+// TwoFactorEnabled сообщает, включен ли у пользователя TOTP
+func TwoFactorEnabled(username string) (bool, error) {
+	var enabled bool
+	err := database.DB.QueryRow(`
+		SELECT totp_enabled_at IS NOT NULL FROM users WHERE username = $1
+	`, username).Scan(&enabled)
+	return enabled, err
+}
+
+// StartTOTPEnrollment генерирует новый секрет; он начнет действовать
+// только после подтверждения кодом
+func StartTOTPEnrollment(username string) (secret, uri string, err error) {
+	secret, err = GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	_, err = database.DB.Exec(`UPDATE users SET totp_pending_secret = $2 WHERE username = $1`, username, secret)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, TOTPURI(totpIssuer, username, secret), nil
+}
+
+// ConfirmTOTPEnrollment активирует ожидающий секрет по верному коду
+// и выдает новый набор кодов восстановления
+func ConfirmTOTPEnrollment(username, code string) ([]string, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var pending sql.NullString
+	err = tx.QueryRow(`
+		SELECT totp_pending_secret FROM users WHERE username = $1 FOR UPDATE
+	`, username).Scan(&pending)
+	if err != nil {
+		return nil, err
+	}
+	if !pending.Valid {
+		return nil, ErrNoPendingEnrollment
+	}
+
+	step, ok := VerifyTOTP(pending.String, code, 0)
+	if !ok {
+		return nil, ErrInvalidTOTPCode
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET totp_secret = totp_pending_secret, totp_pending_secret = NULL,
+			totp_enabled_at = NOW(), totp_last_step = $2
+		WHERE username = $1
+	`, username, step)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(tx, username)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// VerifySecondFactor принимает либо TOTP-код, либо неиспользованный код восстановления
+func VerifySecondFactor(username, code, recoveryCode string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if recoveryCode != "" {
+		result, err := tx.Exec(`
+			UPDATE recovery_codes SET used_at = NOW()
+			WHERE username = $1 AND code_hash = $2 AND used_at IS NULL
+		`, username, HashToken(normalizeRecoveryCode(recoveryCode)))
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return ErrInvalidTOTPCode
+		}
+		return tx.Commit()
+	}
+
+	var (
+		secret   sql.NullString
+		lastStep int64
+	)
+	err = tx.QueryRow(`
+		SELECT totp_secret, totp_last_step FROM users
+		WHERE username = $1 AND totp_enabled_at IS NOT NULL
+		FOR UPDATE
+	`, username).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows || (err == nil && !secret.Valid) {
+		return ErrInvalidTOTPCode
+	}
+	if err != nil {
+		return err
+	}
+
+	step, ok := VerifyTOTP(secret.String, code, lastStep)
+	if !ok {
+		return ErrInvalidTOTPCode
+	}
+	if _, err := tx.Exec(`UPDATE users SET totp_last_step = $2 WHERE username = $1`, username, step); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP выключает второй фактор и удаляет коды восстановления
+func DisableTOTP(username string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET totp_secret = NULL, totp_pending_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0
+		WHERE username = $1
+	`, username)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE username = $1`, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RegenerateRecoveryCodes заменяет все коды восстановления новыми
+func RegenerateRecoveryCodes(username string) ([]string, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, username)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, username string) ([]string, error) {
+	codes, err := GenerateRecoveryCodes(recoveryCodesPerIssue)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = HashToken(normalizeRecoveryCode(code))
+	}
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE username = $1`, username); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO recovery_codes (username, code_hash)
+		SELECT $1, UNNEST($2::text[])
+	`, username, pq.Array(hashes))
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
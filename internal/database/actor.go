@@ -0,0 +1,21 @@
+package database
+
+import "database/sql"
+
+// WithUser выполняет fn в транзакции, в которой триггер истории товаров
+// записывает username как автора изменений (app.current_user)
+func WithUser(username string, fn func(tx *sql.Tx) error) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT set_config('app.current_user', $1, true)`, username); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -5,11 +5,17 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 	_ "github.com/lib/pq"
 )
 
 var DB *sql.DB
 
+// Location - часовой пояс сессий БД (настройка TimeZone). В нем
+// CURRENT_TIMESTAMP заполняет колонки TIMESTAMP без пояса, например
+// item_history.changed_at, и сравнивать с ними нужно время по тем же часам
+var Location = time.UTC
+
 func Init() error {
 	connStr := fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
@@ -28,10 +34,27 @@ func Init() error {
 	if err != nil {
 		return err
 	}
+	if err := LoadLocation(); err != nil {
+		return err
+	}
 	log.Println("Connected to database")
 	return nil
 }
 
+// LoadLocation читает часовой пояс сессий БД в Location
+func LoadLocation() error {
+	var zone string
+	if err := DB.QueryRow(`SHOW TimeZone`).Scan(&zone); err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return fmt.Errorf("unsupported database TimeZone %q: %w", zone, err)
+	}
+	Location = loc
+	return nil
+}
+
 func Close() {
 	if DB != nil {
 		DB.Close()
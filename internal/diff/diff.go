@@ -0,0 +1,218 @@
+// Package diff сравнивает jsonb-снимки записей истории по полям. Набор полей
+// берется из самих снимков, поэтому новая колонка таблицы попадает в
+// сравнение без правок кода.
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"sort"
+	"strings"
+	"3.7/internal/models"
+)
+
+// Options задает представление результата для конкретной таблицы
+type Options struct {
+	// Поля, которые меняются сами и в сравнении не участвуют
+	Ignore map[string]bool
+	// Порядок полей в результате; остальные поля идут следом по алфавиту
+	Order []string
+	// Текстовые поля, для которых строится пословное сравнение
+	Text map[string]bool
+}
+
+// Items - настройки для снимков товаров
+var Items = Options{
+	Ignore: map[string]bool{"id": true, "created_at": true, "updated_at": true, "version": true},
+	Order:  []string{"name", "description", "quantity", "price", "location", "created_by"},
+	Text:   map[string]bool{"description": true},
+}
+
+// Decode разбирает снимок; пустая строка или null - записи нет.
+// Числа остаются json.Number, чтобы разница считалась без потерь.
+func Decode(data string) (map[string]interface{}, error) {
+	if data == "" || data == "null" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	var snapshot map[string]interface{}
+	if err := dec.Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Rows сравнивает два снимка в виде JSON
+func Rows(before, after string, opts Options) ([]models.DiffResponse, error) {
+	b, err := Decode(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := Decode(after)
+	if err != nil {
+		return nil, err
+	}
+	return Snapshots(b, a, opts), nil
+}
+
+// Changes - изменения в виде {"поле": {"old": ..., "new": ...}}: в таком
+// виде history API отдает поле changes записей истории
+func Changes(diffs []models.DiffResponse) map[string]interface{} {
+	changes := make(map[string]interface{}, len(diffs))
+	for _, d := range diffs {
+		changes[d.Field] = map[string]interface{}{"old": d.Old, "new": d.New}
+	}
+	return changes
+}
+
+// Snapshots сравнивает два снимка по полям. Отсутствующий снимок (до создания
+// или после удаления записи) сравнивается как набор пустых значений, так что
+// создание и удаление дают те же пары old/new, что и изменение.
+// Для числовых полей считается разница new - old.
+func Snapshots(before, after map[string]interface{}, opts Options) []models.DiffResponse {
+	seen := map[string]bool{}
+	var fields, extra []string
+	for _, f := range opts.Order {
+		seen[f] = true
+		fields = append(fields, f)
+	}
+	for _, snapshot := range []map[string]interface{}{before, after} {
+		for f := range snapshot {
+			if !seen[f] && !opts.Ignore[f] {
+				seen[f] = true
+				extra = append(extra, f)
+			}
+		}
+	}
+	sort.Strings(extra)
+	fields = append(fields, extra...)
+
+	diffs := []models.DiffResponse{}
+	for _, field := range fields {
+		oldValue, newValue := before[field], after[field]
+		if Equal(oldValue, newValue) {
+			continue
+		}
+		d := models.DiffResponse{Field: field, Old: oldValue, New: newValue}
+		d.Delta = delta(oldValue, newValue)
+		if opts.Text[field] {
+			oldText, _ := oldValue.(string)
+			newText, _ := newValue.(string)
+			d.Words = Words(oldText, newText)
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+// Equal сравнивает значения из снимков; числа сравниваются по значению
+// (10.1 и 10.10 равны)
+func Equal(a, b interface{}) bool {
+	if na, ok := a.(json.Number); ok {
+		if nb, ok := b.(json.Number); ok {
+			ra, okA := new(big.Rat).SetString(na.String())
+			rb, okB := new(big.Rat).SetString(nb.String())
+			if okA && okB {
+				return ra.Cmp(rb) == 0
+			}
+		}
+	}
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
+
+// delta - new - old для числовых значений; отсутствующее значение - ноль.
+// Если хотя бы одно значение не число, разницы нет.
+func delta(oldValue, newValue interface{}) *json.Number {
+	toRat := func(v interface{}) (*big.Rat, bool, bool) {
+		if v == nil {
+			return new(big.Rat), true, false
+		}
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, false, false
+		}
+		r, ok := new(big.Rat).SetString(n.String())
+		return r, ok, ok
+	}
+	a, okA, numA := toRat(oldValue)
+	b, okB, numB := toRat(newValue)
+	if !okA || !okB || (!numA && !numB) {
+		return nil
+	}
+	d := new(big.Rat).Sub(b, a)
+	var s string
+	if d.IsInt() {
+		s = d.Num().String()
+	} else {
+		s = strings.TrimRight(d.FloatString(10), "0")
+	}
+	n := json.Number(s)
+	return &n
+}
+
+// maxWords - предел слов в одном тексте для пословного сравнения: таблица НОП
+// растет как произведение длин текстов
+const maxWords = 500
+
+// Words сравнивает тексты по словам (наибольшая общая подпоследовательность);
+// соседние слова с одной операцией склеиваются в один фрагмент.
+// Если в одном из текстов больше maxWords слов, возвращает nil: изменение
+// остается только парой old/new целиком.
+func Words(oldText, newText string) []models.WordDiff {
+	a, b := strings.Fields(oldText), strings.Fields(newText)
+	if len(a) > maxWords || len(b) > maxWords {
+		return nil
+	}
+
+	// lcs[i][j] - длина НОП для a[i:] и b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []models.WordDiff
+	add := func(op, word string) {
+		if n := len(ops); n > 0 && ops[n-1].Op == op {
+			ops[n-1].Text += " " + word
+			return
+		}
+		ops = append(ops, models.WordDiff{Op: op, Text: word})
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			add("equal", a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			add("delete", a[i])
+			i++
+		default:
+			add("insert", b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		add("delete", a[i])
+	}
+	for ; j < len(b); j++ {
+		add("insert", b[j])
+	}
+	return ops
+}
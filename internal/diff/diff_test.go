@@ -0,0 +1,254 @@
+package diff
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"3.7/internal/models"
+)
+
+func num(s string) *json.Number {
+	n := json.Number(s)
+	return &n
+}
+
+func TestSnapshots(t *testing.T) {
+	bolt := `{"id": 1, "name": "Bolt", "quantity": 10, "price": 1.5,
+		"created_at": "2026-01-01T10:00:00", "updated_at": "2026-01-01T10:00:00", "version": 1}`
+
+	cases := []struct {
+		name          string
+		before, after string
+		opts          Options
+		want          []models.DiffResponse
+	}{
+		{
+			// Снимка до создания нет: поля сравниваются с пустыми значениями
+			name:   "create",
+			before: "",
+			after:  bolt,
+			opts:   Items,
+			want: []models.DiffResponse{
+				{Field: "name", Old: nil, New: "Bolt"},
+				{Field: "quantity", Old: nil, New: json.Number("10"), Delta: num("10")},
+				{Field: "price", Old: nil, New: json.Number("1.5"), Delta: num("1.5")},
+			},
+		},
+		{
+			name:   "delete",
+			before: bolt,
+			after:  "null",
+			opts:   Items,
+			want: []models.DiffResponse{
+				{Field: "name", Old: "Bolt", New: nil},
+				{Field: "quantity", Old: json.Number("10"), New: nil, Delta: num("-10")},
+				{Field: "price", Old: json.Number("1.5"), New: nil, Delta: num("-1.5")},
+			},
+		},
+		{
+			name:   "only ignored fields changed",
+			before: `{"id": 1, "name": "Bolt", "updated_at": "2026-01-01T10:00:00", "version": 1}`,
+			after:  `{"id": 1, "name": "Bolt", "updated_at": "2026-01-02T10:00:00", "version": 2}`,
+			opts:   Items,
+			want:   []models.DiffResponse{},
+		},
+		{
+			name:   "custom ignore",
+			before: `{"name": "Bolt", "note": "a"}`,
+			after:  `{"name": "Nut", "note": "b"}`,
+			opts:   Options{Ignore: map[string]bool{"note": true}},
+			want:   []models.DiffResponse{{Field: "name", Old: "Bolt", New: "Nut"}},
+		},
+		{
+			// jsonb может отдать одно число в разной записи
+			name:   "numbers equal by value",
+			before: `{"price": 10.1, "quantity": 5}`,
+			after:  `{"price": 10.10, "quantity": 5.0}`,
+			opts:   Items,
+			want:   []models.DiffResponse{},
+		},
+		{
+			// В float64 0.3 - 0.1 дало бы 0.19999999999999998
+			name:   "delta precision",
+			before: `{"price": 0.1, "quantity": 7}`,
+			after:  `{"price": 0.3, "quantity": 3}`,
+			opts:   Items,
+			want: []models.DiffResponse{
+				{Field: "quantity", Old: json.Number("7"), New: json.Number("3"), Delta: num("-4")},
+				{Field: "price", Old: json.Number("0.1"), New: json.Number("0.3"), Delta: num("0.2")},
+			},
+		},
+		{
+			name:   "small delta",
+			before: `{"price": 19.99}`,
+			after:  `{"price": 20}`,
+			opts:   Items,
+			want: []models.DiffResponse{
+				{Field: "price", Old: json.Number("19.99"), New: json.Number("20"), Delta: num("0.01")},
+			},
+		},
+		{
+			name:   "no delta for non-numbers",
+			before: `{"location": "A-1"}`,
+			after:  `{"location": "A-2"}`,
+			opts:   Items,
+			want:   []models.DiffResponse{{Field: "location", Old: "A-1", New: "A-2"}},
+		},
+		{
+			name:   "words for text fields",
+			before: `{"description": "red steel bolt"}`,
+			after:  `{"description": "red brass bolt"}`,
+			opts:   Items,
+			want: []models.DiffResponse{{
+				Field: "description", Old: "red steel bolt", New: "red brass bolt",
+				Words: []models.WordDiff{
+					{Op: "equal", Text: "red"},
+					{Op: "delete", Text: "steel"},
+					{Op: "insert", Text: "brass"},
+					{Op: "equal", Text: "bolt"},
+				},
+			}},
+		},
+		{
+			name:   "no words for other strings",
+			before: `{"name": "red bolt"}`,
+			after:  `{"name": "blue bolt"}`,
+			opts:   Items,
+			want:   []models.DiffResponse{{Field: "name", Old: "red bolt", New: "blue bolt"}},
+		},
+		{
+			// Колонки не из Order идут после известных по алфавиту,
+			// из какого бы снимка они ни пришли
+			name:   "extra columns in alphabetical order",
+			before: `{"zeta": 1, "name": "Bolt", "alpha": "a"}`,
+			after:  `{"mid": true, "name": "Nut", "alpha": "b", "zeta": 2}`,
+			opts:   Items,
+			want: []models.DiffResponse{
+				{Field: "name", Old: "Bolt", New: "Nut"},
+				{Field: "alpha", Old: "a", New: "b"},
+				{Field: "mid", Old: nil, New: true},
+				{Field: "zeta", Old: json.Number("1"), New: json.Number("2"), Delta: num("1")},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			before, err := Decode(tc.before)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := Decode(tc.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := Snapshots(before, after, tc.opts)
+			if !reflect.DeepEqual(got, tc.want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(tc.want)
+				t.Errorf("Snapshots:\n got %s\nwant %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestDecodeEmpty(t *testing.T) {
+	for _, data := range []string{"", "null"} {
+		snapshot, err := Decode(data)
+		if err != nil || snapshot != nil {
+			t.Errorf("Decode(%q) = %v, %v; want nil, nil", data, snapshot, err)
+		}
+	}
+	if _, err := Decode("{"); err == nil {
+		t.Error("Decode of broken JSON: want error")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	cases := []struct {
+		a, b interface{}
+		want bool
+	}{
+		{json.Number("10.1"), json.Number("10.10"), true},
+		{json.Number("1"), json.Number("1.0"), true},
+		{json.Number("1e2"), json.Number("100"), true},
+		{json.Number("1"), json.Number("2"), false},
+		{json.Number("10"), "10", false},
+		{nil, nil, true},
+		{nil, "", false},
+		{"a", "a", true},
+		{true, false, false},
+	}
+	for _, tc := range cases {
+		if got := Equal(tc.a, tc.b); got != tc.want {
+			t.Errorf("Equal(%#v, %#v) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	diffs, err := Rows(`{"id": 1, "name": "Bolt", "price": 1.50, "version": 1}`,
+		`{"id": 1, "name": "Nut", "price": 1.5, "version": 2}`, Items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(Changes(diffs))
+	if want := `{"name":{"new":"Nut","old":"Bolt"}}`; string(got) != want {
+		t.Errorf("Changes = %s, want %s", got, want)
+	}
+}
+
+func TestWords(t *testing.T) {
+	cases := []struct {
+		name     string
+		old, new string
+		want     []models.WordDiff
+	}{
+		{"identical", "steel bolt", "steel bolt", []models.WordDiff{{Op: "equal", Text: "steel bolt"}}},
+		{"whitespace ignored", "steel   bolt\n", "steel bolt", []models.WordDiff{{Op: "equal", Text: "steel bolt"}}},
+		{"append", "bolt", "bolt M6 zinc", []models.WordDiff{
+			{Op: "equal", Text: "bolt"},
+			{Op: "insert", Text: "M6 zinc"},
+		}},
+		{"remove from start", "old steel bolt", "steel bolt", []models.WordDiff{
+			{Op: "delete", Text: "old"},
+			{Op: "equal", Text: "steel bolt"},
+		}},
+		{"from empty", "", "new bolt", []models.WordDiff{{Op: "insert", Text: "new bolt"}}},
+		{"to empty", "old bolt", "", []models.WordDiff{{Op: "delete", Text: "old bolt"}}},
+		{"both empty", "", "", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Words(tc.old, tc.new); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Words(%q, %q) = %+v, want %+v", tc.old, tc.new, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWordsLimit(t *testing.T) {
+	words := func(n int, last string) string {
+		return strings.Repeat("word ", n-1) + last
+	}
+
+	if got := Words(words(maxWords, "old"), words(maxWords, "new")); len(got) != 3 {
+		t.Errorf("at the limit: %d fragments, want 3", len(got))
+	}
+	if got := Words(words(maxWords+1, "old"), "new"); got != nil {
+		t.Errorf("old text over the limit: %d fragments, want nil", len(got))
+	}
+	if got := Words("old", words(maxWords+1, "new")); got != nil {
+		t.Errorf("new text over the limit: %d fragments, want nil", len(got))
+	}
+
+	// Длинное описание остается парой old/new без пословного сравнения
+	oldText, newText := words(maxWords+1, "old"), words(maxWords+1, "new")
+	got := Snapshots(map[string]interface{}{"description": oldText},
+		map[string]interface{}{"description": newText}, Items)
+	want := []models.DiffResponse{{Field: "description", Old: oldText, New: newText}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Snapshots over the limit = %+v, want whole-value diff", got)
+	}
+}
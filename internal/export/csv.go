@@ -0,0 +1,106 @@
+package export
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"3.7/internal/models"
+)
+
+// csvWriter - таблица с парами колонок old/new; значения только у измененных полей
+type csvWriter struct {
+	w      *csv.Writer
+	fields []Field
+}
+
+func newCSV(w io.Writer, r Report) (Writer, error) {
+	cw := &csvWriter{w: csv.NewWriter(w), fields: r.Fields}
+	if err := cw.w.Write(headers(r.Fields)); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) Write(h models.HistoryEntry) error {
+	e, err := parse(h)
+	if err != nil {
+		return err
+	}
+
+	record := []string{
+		strconv.Itoa(e.ID),
+		strconv.Itoa(e.ItemID),
+		csvText(e.ItemName),
+		e.Action,
+		csvText(e.ChangedBy),
+		e.ChangedAt.Format(timeLayout),
+		"",
+		strconv.Itoa(e.ChangedCount),
+	}
+	if e.Version != nil {
+		record[6] = strconv.Itoa(*e.Version)
+	}
+	for _, field := range cw.fields {
+		d, changed := e.byField[field.Name]
+		if !changed {
+			record = append(record, "", "")
+			continue
+		}
+		record = append(record, csvValue(d.Old), csvValue(d.New))
+	}
+	return cw.w.Write(record)
+}
+
+// csvInventoryWriter - текущие товары, по колонке на поле
+type csvInventoryWriter struct {
+	csvWriter
+}
+
+func newCSVInventory(w io.Writer, r Report) (InventoryWriter, error) {
+	cw := &csvInventoryWriter{csvWriter{w: csv.NewWriter(w), fields: r.Fields}}
+	var header []string
+	for _, f := range r.Fields {
+		header = append(header, f.Name)
+	}
+	if err := cw.w.Write(header); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvInventoryWriter) Write(item map[string]interface{}) error {
+	record := make([]string, len(cw.fields))
+	for i, field := range cw.fields {
+		record[i] = csvValue(item[field.Name])
+	}
+	return cw.w.Write(record)
+}
+
+// csvValue - значение поля для ячейки CSV; строки экранируются csvText,
+// числа из снимков остаются числами
+func csvValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return csvText(s)
+	}
+	return text(v)
+}
+
+// csvText защищает от подстановки формул: Excel и LibreOffice исполняют
+// ячейку, начинающуюся с = + - @ (а также с табуляции или перевода строки),
+// поэтому перед таким значением ставится апостроф
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func (cw *csvWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func (cw *csvWriter) Close() error {
+	return cw.Flush()
+}
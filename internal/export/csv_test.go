@@ -0,0 +1,64 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+	"3.7/internal/models"
+)
+
+func TestCSVText(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"=HYPERLINK(\"http://evil\")", "'=HYPERLINK(\"http://evil\")"},
+		{"+1+1", "'+1+1"},
+		{"-2+3", "'-2+3"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"\r=1", "'\r=1"},
+		{"Bolt = M6", "Bolt = M6"},
+		{"", ""},
+	}
+	for _, tc := range cases {
+		if got := csvText(tc.in); got != tc.want {
+			t.Errorf("csvText(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestCSVEscapesFormulas(t *testing.T) {
+	format, _ := Lookup("csv")
+	var buf bytes.Buffer
+	w, err := format.Open(&buf, Report{Fields: []Field{{Name: "name"}, {Name: "quantity"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write(models.HistoryEntry{
+		ItemHistory: models.ItemHistory{
+			ID: 1, ItemID: 2, Action: "UPDATE", ChangedBy: "@admin", ChangedAt: time.Now(),
+			OldData: `{"name": "Bolt", "quantity": -1}`,
+			NewData: `{"name": "=cmd|' /C calc'!A0", "quantity": 5}`,
+		},
+		ItemName: "-Bolt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := records[1]
+	// Item Name, Changed By, name (old/new), quantity (old/new)
+	got := []string{row[2], row[4], row[8], row[9], row[10], row[11]}
+	want := []string{"'-Bolt", "'@admin", "Bolt", "'=cmd|' /C calc'!A0", "-1", "5"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("cell %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
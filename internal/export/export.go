@@ -0,0 +1,255 @@
+// Package export выгружает записи истории товаров и текущие остатки склада
+// в файлы: CSV, XLSX, JSON Lines и PDF-отчет для аудита. Записи передаются
+// порциями, так что потоковые форматы (CSV, JSON Lines) не держат выгрузку
+// в памяти целиком. Документы (XLSX, PDF) собираются до конца выгрузки,
+// поэтому число строк в них ограничено (Format.MaxRows).
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"3.7/internal/diff"
+	"3.7/internal/models"
+)
+
+// Field - колонка товара, изменения которой попадают в выгрузку
+type Field struct {
+	Name string
+	// Тип колонки из information_schema (integer, numeric, text, timestamp ...)
+	Type string
+}
+
+// Report - описание выгрузки для заголовков документов
+type Report struct {
+	Title       string
+	GeneratedBy string
+	GeneratedAt time.Time
+	// Период из фильтра; nil - без ограничения
+	From *time.Time
+	To   *time.Time
+	// Условия фильтра кроме периода, в порядке вывода ("Action: UPDATE")
+	Filters []string
+	Fields  []Field
+}
+
+// Writer принимает записи истории в порядке выгрузки
+type Writer interface {
+	Write(h models.HistoryEntry) error
+	// Flush отдает накопленное клиенту; документы собираются целиком
+	// и пишутся только в Close
+	Flush() error
+	Close() error
+}
+
+// Format - формат выгрузки
+type Format struct {
+	Name        string
+	ContentType string
+	Extension   string
+	// Записи должны идти сгруппированными по товару (лист или раздел на товар)
+	ByItem bool
+	// Наибольшее число строк выгрузки; 0 - без ограничения
+	MaxRows int
+
+	open          func(w io.Writer, r Report) (Writer, error)
+	openInventory func(w io.Writer, r Report) (InventoryWriter, error)
+}
+
+// Open начинает выгрузку истории в w
+func (f *Format) Open(w io.Writer, r Report) (Writer, error) {
+	return f.open(w, r)
+}
+
+// OpenInventory начинает выгрузку текущих товаров в w
+func (f *Format) OpenInventory(w io.Writer, r Report) (InventoryWriter, error) {
+	return f.openInventory(w, r)
+}
+
+var formats = map[string]*Format{
+	"csv": {
+		Name:          "csv",
+		ContentType:   "text/csv",
+		Extension:     "csv",
+		open:          newCSV,
+		openInventory: newCSVInventory,
+	},
+	"jsonl": {
+		Name:          "jsonl",
+		ContentType:   "application/x-ndjson",
+		Extension:     "jsonl",
+		open:          newJSONL,
+		openInventory: newJSONLInventory,
+	},
+	"xlsx": {
+		Name:          "xlsx",
+		ContentType:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		Extension:     "xlsx",
+		ByItem:        true,
+		MaxRows:       100000,
+		open:          newXLSX,
+		openInventory: newXLSXInventory,
+	},
+	"pdf": {
+		Name:          "pdf",
+		ContentType:   "application/pdf",
+		Extension:     "pdf",
+		ByItem:        true,
+		MaxRows:       5000,
+		open:          newPDF,
+		openInventory: newPDFInventory,
+	},
+}
+
+// Names - поддерживаемые форматы для сообщений об ошибке
+const Names = "csv, xlsx, jsonl, pdf"
+
+// Lookup возвращает формат по имени; пустое имя - CSV
+func Lookup(name string) (*Format, bool) {
+	if name == "" {
+		name = "csv"
+	}
+	f, ok := formats[strings.ToLower(name)]
+	return f, ok
+}
+
+// entry - запись истории, разобранная для выгрузки
+type entry struct {
+	models.HistoryEntry
+	// Число измененных полей; у создания и удаления - 0
+	ChangedCount int
+	// Изменения по полям, в том числе для CREATE и DELETE
+	Diffs   []models.DiffResponse
+	byField map[string]models.DiffResponse
+	// Запись изменила существующий товар (есть оба снимка). Создание и
+	// удаление, в том числе их откаты, затрагивают все поля сразу и в счет
+	// измененных полей не входят: они видны по действию
+	updated bool
+}
+
+func parse(h models.HistoryEntry) (*entry, error) {
+	before, err := diff.Decode(h.OldData)
+	if err != nil {
+		return nil, fmt.Errorf("entry %d: %w", h.ID, err)
+	}
+	after, err := diff.Decode(h.NewData)
+	if err != nil {
+		return nil, fmt.Errorf("entry %d: %w", h.ID, err)
+	}
+	diffs := diff.Snapshots(before, after, diff.Items)
+	e := &entry{
+		HistoryEntry: h,
+		Diffs:        diffs,
+		byField:      map[string]models.DiffResponse{},
+		updated:      before != nil && after != nil,
+	}
+	if e.updated {
+		e.ChangedCount = len(diffs)
+	}
+	for _, d := range diffs {
+		e.byField[d.Field] = d
+	}
+	return e, nil
+}
+
+// fieldTally - сколько раз менялось каждое поле в записях-изменениях
+type fieldTally map[string]int
+
+func (t fieldTally) add(e *entry) {
+	if !e.updated {
+		return
+	}
+	for _, d := range e.Diffs {
+		t[d.Field]++
+	}
+}
+
+// String - "price: 3, quantity: 1" по алфавиту полей
+func (t fieldTally) String() string {
+	if len(t) == 0 {
+		return "none"
+	}
+	fields := make([]string, 0, len(t))
+	for field := range t {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		parts[i] = field + ": " + strconv.Itoa(t[field])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// headers - общие колонки табличных форматов: сведения о записи, затем
+// пары "<поле> (old)" / "<поле> (new)"
+func headers(fields []Field) []string {
+	h := []string{
+		"ID",
+		"Item ID",
+		"Item Name",
+		"Action",
+		"Changed By",
+		"Changed At",
+		"Version",
+		"Changed Fields Count",
+	}
+	for _, f := range fields {
+		h = append(h, f.Name+" (old)", f.Name+" (new)")
+	}
+	return h
+}
+
+// timeLayout - формат времени в выгрузках
+const timeLayout = "2006-01-02 15:04:05"
+
+// text - значение поля из снимка в виде текста
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// snapshotTime разбирает время из снимка to_jsonb (timestamp без пояса)
+func snapshotTime(s string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02T15:04:05.999999", time.RFC3339Nano} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// period - период отчета в виде текста
+func (r Report) period() string {
+	bound := func(t *time.Time) string {
+		if t == nil {
+			return "..."
+		}
+		return t.Format(timeLayout)
+	}
+	if r.From == nil && r.To == nil {
+		return "all records"
+	}
+	return bound(r.From) + " - " + bound(r.To)
+}
+
+// itemLabel - подпись товара в листах и разделах
+func itemLabel(h models.HistoryEntry) string {
+	if h.ItemName == "" {
+		return "Item #" + strconv.Itoa(h.ItemID)
+	}
+	return "Item #" + strconv.Itoa(h.ItemID) + " - " + h.ItemName
+}
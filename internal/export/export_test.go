@@ -0,0 +1,45 @@
+package export
+
+import (
+	"testing"
+	"3.7/internal/models"
+)
+
+func TestChangedFieldsCount(t *testing.T) {
+	bolt := `{"id": 1, "name": "Bolt", "quantity": 10, "price": 1.50, "location": "A-1", "version": 1}`
+	entries := []struct {
+		action   string
+		old, new string
+		want     int
+	}{
+		{"CREATE", "", bolt, 0},
+		{"UPDATE", bolt, `{"id": 1, "name": "Bolt", "quantity": 12, "price": 1.5, "location": "A-1", "version": 2}`, 1},
+		{"UPDATE", bolt, `{"id": 1, "name": "Nut", "quantity": 12, "price": 1.5, "location": "A-1", "version": 3}`, 2},
+		{"DELETE", bolt, "", 0},
+		// Откат удаления восстанавливает товар целиком - это не изменение полей
+		{"REVERT", "", bolt, 0},
+	}
+
+	tally := fieldTally{}
+	for i, tc := range entries {
+		e, err := parse(models.HistoryEntry{ItemHistory: models.ItemHistory{
+			ID: i + 1, ItemID: 1, Action: tc.action, OldData: tc.old, NewData: tc.new,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.ChangedCount != tc.want {
+			t.Errorf("entry %d (%s): changed fields = %d, want %d", i+1, tc.action, e.ChangedCount, tc.want)
+		}
+		if tc.action == "CREATE" && len(e.Diffs) == 0 {
+			t.Error("CREATE entry: field values are still shown")
+		}
+		tally.add(e)
+	}
+	if got, want := tally.String(), "name: 1, quantity: 2"; got != want {
+		t.Errorf("tally = %q, want %q", got, want)
+	}
+	if got := (fieldTally{}).String(); got != "none" {
+		t.Errorf("empty tally = %q, want none", got)
+	}
+}
@@ -0,0 +1,53 @@
+package export
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+)
+
+// InventoryWriter принимает текущие товары склада: снимки строк items
+// (to_jsonb), разобранные diff.Decode. Колонки выгрузки - Report.Fields.
+type InventoryWriter interface {
+	Write(item map[string]interface{}) error
+	// Flush отдает накопленное клиенту, как у Writer
+	Flush() error
+	Close() error
+}
+
+// inventoryTotals - итоги остатков: число товаров, общее количество и
+// стоимость (quantity * price), без ошибок округления float64
+type inventoryTotals struct {
+	items    int
+	quantity big.Rat
+	value    big.Rat
+}
+
+func (t *inventoryTotals) add(item map[string]interface{}) {
+	t.items++
+	quantity, ok := rat(item["quantity"])
+	if !ok {
+		return
+	}
+	t.quantity.Add(&t.quantity, quantity)
+	if price, ok := rat(item["price"]); ok {
+		t.value.Add(&t.value, new(big.Rat).Mul(quantity, price))
+	}
+}
+
+// params - итоги для шапки документа
+func (t *inventoryTotals) params() [][2]string {
+	return [][2]string{
+		{"Items", strconv.Itoa(t.items)},
+		{"Total quantity", t.quantity.RatString()},
+		{"Total value", t.value.FloatString(2)},
+	}
+}
+
+func rat(v interface{}) (*big.Rat, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil, false
+	}
+	return new(big.Rat).SetString(n.String())
+}
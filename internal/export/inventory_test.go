@@ -0,0 +1,127 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"3.7/internal/diff"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func inventoryItems(t *testing.T) []map[string]interface{} {
+	t.Helper()
+	var items []map[string]interface{}
+	for _, data := range []string{
+		`{"id": 1, "name": "Bolt", "quantity": 3, "price": 0.1, "location": "A-1", "updated_at": "2026-03-01T10:00:00"}`,
+		`{"id": 2, "name": "=SUM(A1)", "quantity": 7, "price": 19.99, "location": "B-2", "updated_at": "2026-03-02T10:00:00"}`,
+	} {
+		item, err := diff.Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+var inventoryReport = Report{
+	Title:       "Inventory report",
+	GeneratedBy: "admin",
+	GeneratedAt: time.Date(2026, 3, 3, 12, 0, 0, 0, time.UTC),
+	Fields: []Field{
+		{Name: "id", Type: "integer"},
+		{Name: "name", Type: "character varying"},
+		{Name: "quantity", Type: "integer"},
+		{Name: "price", Type: "numeric"},
+		{Name: "updated_at", Type: "timestamp without time zone"},
+	},
+}
+
+func TestInventoryTotals(t *testing.T) {
+	var totals inventoryTotals
+	for _, item := range inventoryItems(t) {
+		totals.add(item)
+	}
+	// 3 * 0.1 + 7 * 19.99 без ошибок округления float64
+	want := [][2]string{{"Items", "2"}, {"Total quantity", "10"}, {"Total value", "140.23"}}
+	if got := totals.params(); !reflect.DeepEqual(got, want) {
+		t.Errorf("params = %v, want %v", got, want)
+	}
+}
+
+func writeInventory(t *testing.T, name string) []byte {
+	t.Helper()
+	format, ok := Lookup(name)
+	if !ok {
+		t.Fatalf("format %s not found", name)
+	}
+	var buf bytes.Buffer
+	w, err := format.OpenInventory(&buf, inventoryReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range inventoryItems(t) {
+		if err := w.Write(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCSVInventory(t *testing.T) {
+	records, err := csv.NewReader(bytes.NewReader(writeInventory(t, "csv"))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"id", "name", "quantity", "price", "updated_at"},
+		{"1", "Bolt", "3", "0.1", "2026-03-01T10:00:00"},
+		{"2", "'=SUM(A1)", "7", "19.99", "2026-03-02T10:00:00"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %q, want %q", records, want)
+	}
+}
+
+func TestJSONLInventory(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(string(writeInventory(t, "jsonl"))), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"price":19.99`) {
+		t.Errorf("jsonl = %q", lines)
+	}
+}
+
+func TestXLSXInventory(t *testing.T) {
+	f, err := excelize.OpenReader(bytes.NewReader(writeInventory(t, "xlsx")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rows, err := f.GetRows(inventorySheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[2][1] != "=SUM(A1)" {
+		t.Errorf("inventory rows = %q", rows)
+	}
+	// Числа записаны числами, а не текстом
+	if typ, _ := f.GetCellType(inventorySheet, "C2"); typ == excelize.CellTypeSharedString || typ == excelize.CellTypeInlineString {
+		t.Errorf("quantity cell type = %v, want number", typ)
+	}
+	if value, _ := f.GetCellValue(summarySheet, "B6"); value != "140.23" {
+		t.Errorf("total value = %q, want 140.23", value)
+	}
+}
+
+func TestPDFInventory(t *testing.T) {
+	if data := writeInventory(t, "pdf"); !bytes.HasPrefix(data, []byte("%PDF-")) {
+		t.Errorf("output is not a PDF: %q", data[:min(len(data), 16)])
+	}
+}
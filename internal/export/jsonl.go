@@ -0,0 +1,88 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+	"3.7/internal/models"
+)
+
+// jsonlRecord - строка JSON Lines: запись истории со снимками как есть
+// и изменениями по полям
+type jsonlRecord struct {
+	ID                int                   `json:"id"`
+	ItemID            int                   `json:"item_id"`
+	ItemName          string                `json:"item_name"`
+	Action            string                `json:"action"`
+	ChangedBy         string                `json:"changed_by"`
+	ChangedAt         time.Time             `json:"changed_at"`
+	RevertedHistoryID *int                  `json:"reverted_history_id"`
+	BatchID           *string               `json:"batch_id"`
+	Version           *int                  `json:"version"`
+	OldData           json.RawMessage       `json:"old_data"`
+	NewData           json.RawMessage       `json:"new_data"`
+	Changes           []models.DiffResponse `json:"changes"`
+}
+
+// jsonlWriter - по одному JSON-объекту на строку, для загрузки в хранилища данных
+type jsonlWriter struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func newJSONL(w io.Writer, r Report) (Writer, error) {
+	buf := bufio.NewWriter(w)
+	return &jsonlWriter{buf: buf, enc: json.NewEncoder(buf)}, nil
+}
+
+func (jw *jsonlWriter) Write(h models.HistoryEntry) error {
+	e, err := parse(h)
+	if err != nil {
+		return err
+	}
+	return jw.enc.Encode(jsonlRecord{
+		ID:                e.ID,
+		ItemID:            e.ItemID,
+		ItemName:          e.ItemName,
+		Action:            e.Action,
+		ChangedBy:         e.ChangedBy,
+		ChangedAt:         e.ChangedAt,
+		RevertedHistoryID: e.RevertedHistoryID,
+		BatchID:           e.BatchID,
+		Version:           e.Version,
+		OldData:           rawSnapshot(e.OldData),
+		NewData:           rawSnapshot(e.NewData),
+		Changes:           e.Diffs,
+	})
+}
+
+// jsonlInventoryWriter - по товару на строку: снимок строки items как есть
+type jsonlInventoryWriter struct {
+	jsonlWriter
+}
+
+func newJSONLInventory(w io.Writer, r Report) (InventoryWriter, error) {
+	buf := bufio.NewWriter(w)
+	return &jsonlInventoryWriter{jsonlWriter{buf: buf, enc: json.NewEncoder(buf)}}, nil
+}
+
+func (jw *jsonlInventoryWriter) Write(item map[string]interface{}) error {
+	return jw.enc.Encode(item)
+}
+
+func (jw *jsonlWriter) Flush() error {
+	return jw.buf.Flush()
+}
+
+func (jw *jsonlWriter) Close() error {
+	return jw.Flush()
+}
+
+// rawSnapshot - снимок jsonb без повторного разбора; отсутствующий - null
+func rawSnapshot(data string) json.RawMessage {
+	if data == "" {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(data)
+}
@@ -0,0 +1,422 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"3.7/internal/models"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// Шрифт отчета. Встроенный Helvetica покрывает только cp1252, поэтому для
+// кириллицы в названиях задается TrueType-шрифт с Unicode:
+//
+//	PDF_FONT_FILE      - обычное начертание (.ttf)
+//	PDF_FONT_BOLD_FILE - полужирное; по умолчанию то же, что PDF_FONT_FILE
+var (
+	fontRegular []byte
+	fontBold    []byte
+)
+
+// Init загружает шрифт отчета из окружения; без PDF_FONT_FILE используется Helvetica
+func Init() error {
+	path := os.Getenv("PDF_FONT_FILE")
+	if path == "" {
+		return nil
+	}
+	regular, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	bold := regular
+	if path := os.Getenv("PDF_FONT_BOLD_FILE"); path != "" {
+		if bold, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	fontRegular, fontBold = regular, bold
+	return nil
+}
+
+// Размеры страницы отчета (A4 альбомная, мм)
+const (
+	pdfMargin = 15.0
+	pdfLine   = 5.0
+)
+
+type pdfColumn struct {
+	title string
+	width float64
+}
+
+// Колонки таблицы изменений: Field, Old, New, Delta
+var pdfColumns = []pdfColumn{
+	{"Field", 45},
+	{"Old value", 95},
+	{"New value", 95},
+	{"Delta", 32},
+}
+
+// pdfWriter - отчет для аудита: шапка с периодом и фильтрами, раздел на
+// каждый товар с таблицами изменений по полям, итоги и блок подписей
+type pdfWriter struct {
+	out    io.Writer
+	report Report
+	pdf    *fpdf.Fpdf
+	font   string
+	// Перевод текста в кодировку шрифта (для Helvetica - cp1252)
+	tr func(string) string
+	// Колонки таблиц и подпись в верхнем колонтитуле справа
+	columns []pdfColumn
+	heading string
+
+	item    int
+	items   int
+	entries int
+	actions map[string]int
+	fields  fieldTally
+	first   time.Time
+	last    time.Time
+}
+
+func newPDF(w io.Writer, r Report) (Writer, error) {
+	pw := newPDFDocument(w, r, pdfColumns, "Period: "+r.period(), [][2]string{{"Period", r.period()}})
+	return pw, pw.pdf.Error()
+}
+
+// newPDFDocument начинает отчет: колонтитулы и первая страница с названием
+// и параметрами (params, затем кто и когда составил, затем фильтры)
+func newPDFDocument(w io.Writer, r Report, columns []pdfColumn, heading string, params [][2]string) *pdfWriter {
+	pdf := fpdf.New("L", "mm", "A4", "")
+	pw := &pdfWriter{
+		out: w, report: r, pdf: pdf, font: "Helvetica",
+		columns: columns, heading: heading, actions: map[string]int{}, fields: fieldTally{},
+	}
+	if fontRegular != nil {
+		pdf.AddUTF8FontFromBytes("report", "", fontRegular)
+		pdf.AddUTF8FontFromBytes("report", "B", fontBold)
+		pw.font, pw.tr = "report", func(s string) string { return s }
+	} else {
+		pw.tr = pdf.UnicodeTranslatorFromDescriptor("")
+	}
+
+	pdf.SetTitle(r.Title, true)
+	pdf.SetAuthor(r.GeneratedBy, true)
+	pdf.SetMargins(pdfMargin, pdfMargin, pdfMargin)
+	pdf.SetAutoPageBreak(true, pdfMargin)
+	pdf.AliasNbPages("")
+	pdf.SetHeaderFunc(pw.header)
+	pdf.SetFooterFunc(pw.footer)
+
+	pdf.AddPage()
+	pw.title(params)
+	return pw
+}
+
+func (pw *pdfWriter) header() {
+	pdf := pw.pdf
+	pdf.SetFont(pw.font, "B", 9)
+	pdf.CellFormat(0, pdfLine, pw.tr(pw.report.Title), "", 0, "L", false, 0, "")
+	pdf.SetFont(pw.font, "", 9)
+	pdf.CellFormat(0, pdfLine, pw.tr(pw.heading), "", 1, "R", false, 0, "")
+	pdf.Line(pdfMargin, pdf.GetY()+1, 297-pdfMargin, pdf.GetY()+1)
+	pdf.Ln(4)
+}
+
+func (pw *pdfWriter) footer() {
+	pdf := pw.pdf
+	pdf.SetY(-pdfMargin + 3)
+	pdf.SetFont(pw.font, "", 8)
+	generated := fmt.Sprintf("Generated %s by %s", pw.report.GeneratedAt.Format(timeLayout), pw.report.GeneratedBy)
+	pdf.CellFormat(0, 4, pw.tr(generated), "", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 4, fmt.Sprintf("Page %d of {nb}", pdf.PageNo()), "", 0, "R", false, 0, "")
+}
+
+// title - первая страница: название и параметры отчета
+func (pw *pdfWriter) title(params [][2]string) {
+	pdf, r := pw.pdf, pw.report
+	pdf.SetFont(pw.font, "B", 16)
+	pdf.CellFormat(0, 10, pw.tr(r.Title), "", 1, "L", false, 0, "")
+
+	pdf.SetFont(pw.font, "", 10)
+	params = append(params,
+		[2]string{"Generated at", r.GeneratedAt.Format(timeLayout)},
+		[2]string{"Generated by", r.GeneratedBy},
+	)
+	for _, filter := range r.Filters {
+		params = append(params, [2]string{"Filter", filter})
+	}
+	for _, p := range params {
+		pdf.CellFormat(35, pdfLine+1, pw.tr(p[0]+":"), "", 0, "L", false, 0, "")
+		pdf.CellFormat(0, pdfLine+1, pw.tr(p[1]), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(4)
+}
+
+func (pw *pdfWriter) Write(h models.HistoryEntry) error {
+	e, err := parse(h)
+	if err != nil {
+		return err
+	}
+	pdf := pw.pdf
+
+	if pw.items == 0 || pw.item != e.ItemID {
+		pw.item = e.ItemID
+		pw.items++
+		pw.space(3 * pdfLine)
+		pdf.Ln(2)
+		pdf.SetFont(pw.font, "B", 12)
+		pdf.CellFormat(0, 8, pw.tr(itemLabel(e.HistoryEntry)), "B", 1, "L", false, 0, "")
+		pdf.Ln(2)
+	}
+
+	pw.entries++
+	pw.actions[e.Action]++
+	pw.fields.add(e)
+	if pw.first.IsZero() || e.ChangedAt.Before(pw.first) {
+		pw.first = e.ChangedAt
+	}
+	if e.ChangedAt.After(pw.last) {
+		pw.last = e.ChangedAt
+	}
+
+	line := fmt.Sprintf("#%d  %s  %s  by %s", e.ID, e.Action, e.ChangedAt.Format(timeLayout), e.ChangedBy)
+	if e.Version != nil {
+		line += fmt.Sprintf("  v%d", *e.Version)
+	}
+	if e.RevertedHistoryID != nil {
+		line += fmt.Sprintf("  (reverts #%d)", *e.RevertedHistoryID)
+	}
+	pw.space(3 * pdfLine)
+	pdf.SetFont(pw.font, "B", 10)
+	pdf.CellFormat(0, pdfLine+1, pw.tr(line), "", 1, "L", false, 0, "")
+
+	if len(e.Diffs) == 0 {
+		pdf.SetFont(pw.font, "", 9)
+		pdf.CellFormat(0, pdfLine, "No field changes", "", 1, "L", false, 0, "")
+	} else {
+		pw.tableHeader()
+		for _, d := range e.Diffs {
+			delta := ""
+			if d.Delta != nil {
+				delta = d.Delta.String()
+			}
+			pw.row([]string{d.Field, text(d.Old), text(d.New), delta})
+		}
+	}
+	pdf.Ln(3)
+	return pdf.Error()
+}
+
+// space переносит вывод на новую страницу, если до конца страницы меньше h
+func (pw *pdfWriter) space(h float64) {
+	_, pageHeight := pw.pdf.GetPageSize()
+	if pw.pdf.GetY()+h > pageHeight-pdfMargin {
+		pw.pdf.AddPage()
+	}
+}
+
+func (pw *pdfWriter) tableHeader() {
+	pdf := pw.pdf
+	pdf.SetFont(pw.font, "B", 9)
+	pdf.SetFillColor(230, 230, 230)
+	for _, col := range pw.columns {
+		pdf.CellFormat(col.width, pdfLine+1, col.title, "1", 0, "L", true, 0, "")
+	}
+	pdf.Ln(-1)
+}
+
+// row - строка таблицы с переносом длинных значений; строка не разрывается
+// между страницами, на новой странице повторяется заголовок таблицы
+func (pw *pdfWriter) row(cells []string) {
+	pdf := pw.pdf
+	pdf.SetFont(pw.font, "", 9)
+
+	lines := 1
+	for i, cell := range cells {
+		if n := pw.lines(cell, pw.columns[i].width); n > lines {
+			lines = n
+		}
+	}
+	height := float64(lines) * pdfLine
+
+	_, pageHeight := pdf.GetPageSize()
+	if pdf.GetY()+height > pageHeight-pdfMargin {
+		pdf.AddPage()
+		pw.tableHeader()
+		pdf.SetFont(pw.font, "", 9)
+	}
+
+	x, y := pdf.GetX(), pdf.GetY()
+	for i, cell := range cells {
+		width := pw.columns[i].width
+		pdf.Rect(x, y, width, height, "D")
+		pdf.SetXY(x, y)
+		pdf.MultiCell(width, pdfLine, pw.tr(cell), "", "L", false)
+		x += width
+	}
+	pdf.SetXY(pdfMargin, y+height)
+}
+
+// lines - число строк текста в колонке шириной w
+func (pw *pdfWriter) lines(s string, w float64) int {
+	if s == "" {
+		return 1
+	}
+	if pw.font == "Helvetica" {
+		return len(pw.pdf.SplitLines([]byte(pw.tr(s)), w))
+	}
+	return len(pw.pdf.SplitText(s, w))
+}
+
+func (pw *pdfWriter) Flush() error {
+	// PDF собирается целиком и отдается в Close
+	return nil
+}
+
+func (pw *pdfWriter) Close() error {
+	pw.summary()
+	pw.signOff()
+	if err := pw.pdf.Error(); err != nil {
+		return err
+	}
+	return pw.pdf.Output(pw.out)
+}
+
+// summary - итоги отчета: число записей и товаров, действия, фактический период
+func (pw *pdfWriter) summary() {
+	pdf := pw.pdf
+	pw.space(10 * pdfLine)
+	pdf.Ln(4)
+	pdf.SetFont(pw.font, "B", 12)
+	pdf.CellFormat(0, 8, "Summary", "B", 1, "L", false, 0, "")
+	pdf.Ln(2)
+
+	pdf.SetFont(pw.font, "", 10)
+	if pw.entries == 0 {
+		pdf.CellFormat(0, pdfLine+1, "No history entries match the report filters.", "", 1, "L", false, 0, "")
+		return
+	}
+
+	actions := make([]string, 0, len(pw.actions))
+	for action := range pw.actions {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	var counts []string
+	for _, action := range actions {
+		counts = append(counts, action+": "+strconv.Itoa(pw.actions[action]))
+	}
+
+	params := [][2]string{
+		{"Entries", strconv.Itoa(pw.entries)},
+		{"Items", strconv.Itoa(pw.items)},
+		{"Actions", strings.Join(counts, ", ")},
+		{"Changed fields", pw.fields.String()},
+		{"First change", pw.first.Format(timeLayout)},
+		{"Last change", pw.last.Format(timeLayout)},
+	}
+	for _, p := range params {
+		pdf.CellFormat(35, pdfLine+1, p[0]+":", "", 0, "L", false, 0, "")
+		pdf.CellFormat(0, pdfLine+1, p[1], "", 1, "L", false, 0, "")
+	}
+}
+
+// signOff - блок подписей: отчет подписывают составитель и проверяющие
+func (pw *pdfWriter) signOff() {
+	pdf := pw.pdf
+	pw.space(12 * pdfLine)
+	pdf.Ln(6)
+	pdf.SetFont(pw.font, "B", 12)
+	pdf.CellFormat(0, 8, "Sign-off", "B", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	pdf.SetFont(pw.font, "", 10)
+	for _, role := range []string{"Prepared by", "Reviewed by", "Approved by"} {
+		name := "______________________________"
+		if role == "Prepared by" {
+			name = pw.report.GeneratedBy
+		}
+		pdf.CellFormat(35, 10, role+":", "", 0, "L", false, 0, "")
+		pdf.CellFormat(80, 10, pw.tr(name), "", 0, "L", false, 0, "")
+		pdf.CellFormat(25, 10, "Signature:", "", 0, "L", false, 0, "")
+		pdf.CellFormat(60, 10, "______________________", "", 0, "L", false, 0, "")
+		pdf.CellFormat(15, 10, "Date:", "", 0, "L", false, 0, "")
+		pdf.CellFormat(0, 10, "______________", "", 1, "L", false, 0, "")
+	}
+}
+
+// Колонки отчета об остатках; остальные поля товара есть в csv, xlsx и jsonl
+var pdfInventoryColumns = []pdfColumn{
+	{"ID", 15},
+	{"Name", 65},
+	{"Description", 80},
+	{"Location", 35},
+	{"Quantity", 22},
+	{"Price", 25},
+	{"Value", 25},
+}
+
+// pdfInventoryWriter - отчет об остатках: таблица товаров, итоги и подписи
+type pdfInventoryWriter struct {
+	doc    *pdfWriter
+	totals inventoryTotals
+}
+
+func newPDFInventory(w io.Writer, r Report) (InventoryWriter, error) {
+	asOf := r.GeneratedAt.Format(timeLayout)
+	doc := newPDFDocument(w, r, pdfInventoryColumns, "As of "+asOf, [][2]string{{"As of", asOf}})
+	doc.tableHeader()
+	return &pdfInventoryWriter{doc: doc}, doc.pdf.Error()
+}
+
+func (pw *pdfInventoryWriter) Write(item map[string]interface{}) error {
+	pw.totals.add(item)
+	value := ""
+	if quantity, ok := rat(item["quantity"]); ok {
+		if price, ok := rat(item["price"]); ok {
+			value = new(big.Rat).Mul(quantity, price).FloatString(2)
+		}
+	}
+	pw.doc.row([]string{
+		text(item["id"]),
+		text(item["name"]),
+		text(item["description"]),
+		text(item["location"]),
+		text(item["quantity"]),
+		text(item["price"]),
+		value,
+	})
+	return pw.doc.pdf.Error()
+}
+
+func (pw *pdfInventoryWriter) Flush() error {
+	return nil
+}
+
+func (pw *pdfInventoryWriter) Close() error {
+	doc := pw.doc
+	pdf := doc.pdf
+	doc.space(6 * pdfLine)
+	pdf.Ln(4)
+	pdf.SetFont(doc.font, "B", 12)
+	pdf.CellFormat(0, 8, "Summary", "B", 1, "L", false, 0, "")
+	pdf.Ln(2)
+	pdf.SetFont(doc.font, "", 10)
+	for _, p := range pw.totals.params() {
+		pdf.CellFormat(35, pdfLine+1, p[0]+":", "", 0, "L", false, 0, "")
+		pdf.CellFormat(0, pdfLine+1, p[1], "", 1, "L", false, 0, "")
+	}
+
+	doc.signOff()
+	if err := pdf.Error(); err != nil {
+		return err
+	}
+	return pdf.Output(doc.out)
+}
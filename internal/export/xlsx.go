@@ -0,0 +1,348 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"3.7/internal/models"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const summarySheet = "Summary"
+
+// xlsxItem - строка листа Summary
+type xlsxItem struct {
+	ID      int
+	Name    string
+	Sheet   string
+	Entries int
+	First   time.Time
+	Last    time.Time
+}
+
+// xlsxWriter - книга с листом на каждый товар и сводным листом Summary.
+// Листы товаров пишутся потоково; записи приходят сгруппированными по товару.
+type xlsxWriter struct {
+	out    io.Writer
+	report Report
+	file   *excelize.File
+	bold   int
+	date   int
+
+	stream *excelize.StreamWriter
+	row    int
+	items  []*xlsxItem
+	fields fieldTally
+}
+
+func newXLSX(w io.Writer, r Report) (Writer, error) {
+	f, bold, date, err := newWorkbook()
+	if err != nil {
+		return nil, err
+	}
+	return &xlsxWriter{out: w, report: r, file: f, bold: bold, date: date, fields: fieldTally{}}, nil
+}
+
+// newWorkbook - книга с листом Summary и стилями заголовка и даты
+func newWorkbook() (f *excelize.File, bold, date int, err error) {
+	f = excelize.NewFile()
+	if err = f.SetSheetName("Sheet1", summarySheet); err != nil {
+		return nil, 0, 0, err
+	}
+	if bold, err = f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}}); err != nil {
+		return nil, 0, 0, err
+	}
+	if date, err = f.NewStyle(&excelize.Style{NumFmt: 22}); err != nil {
+		return nil, 0, 0, err
+	}
+	return f, bold, date, nil
+}
+
+func (xw *xlsxWriter) Write(h models.HistoryEntry) error {
+	e, err := parse(h)
+	if err != nil {
+		return err
+	}
+
+	item := xw.current()
+	if item == nil || item.ID != e.ItemID {
+		if item, err = xw.openSheet(e.HistoryEntry); err != nil {
+			return err
+		}
+	}
+	item.Entries++
+	xw.fields.add(e)
+	if item.First.IsZero() || e.ChangedAt.Before(item.First) {
+		item.First = e.ChangedAt
+	}
+	if e.ChangedAt.After(item.Last) {
+		item.Last = e.ChangedAt
+	}
+
+	values := []interface{}{
+		e.ID,
+		e.ItemID,
+		e.ItemName,
+		e.Action,
+		e.ChangedBy,
+		excelize.Cell{StyleID: xw.date, Value: e.ChangedAt},
+		nil,
+		e.ChangedCount,
+	}
+	if e.Version != nil {
+		values[6] = *e.Version
+	}
+	for _, field := range xw.report.Fields {
+		d, changed := e.byField[field.Name]
+		if !changed {
+			values = append(values, nil, nil)
+			continue
+		}
+		values = append(values, xlsxCell(field, d.Old, xw.date), xlsxCell(field, d.New, xw.date))
+	}
+
+	xw.row++
+	return xw.stream.SetRow(fmt.Sprintf("A%d", xw.row), values)
+}
+
+func (xw *xlsxWriter) current() *xlsxItem {
+	if len(xw.items) == 0 {
+		return nil
+	}
+	return xw.items[len(xw.items)-1]
+}
+
+// openSheet завершает лист предыдущего товара и начинает лист нового
+func (xw *xlsxWriter) openSheet(h models.HistoryEntry) (*xlsxItem, error) {
+	if xw.stream != nil {
+		if err := xw.stream.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	item := &xlsxItem{ID: h.ItemID, Name: h.ItemName, Sheet: fmt.Sprintf("Item %d", h.ItemID)}
+	if _, err := xw.file.NewSheet(item.Sheet); err != nil {
+		return nil, err
+	}
+	sw, err := xw.file.NewStreamWriter(item.Sheet)
+	if err != nil {
+		return nil, err
+	}
+	// Ширина колонок и закрепление задаются до первой строки
+	if err := sw.SetColWidth(3, 3, 30); err != nil {
+		return nil, err
+	}
+	if err := sw.SetColWidth(6, 6, 20); err != nil {
+		return nil, err
+	}
+	if err := sw.SetPanes(&excelize.Panes{
+		Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft",
+	}); err != nil {
+		return nil, err
+	}
+
+	var header []interface{}
+	for _, title := range headers(xw.report.Fields) {
+		header = append(header, excelize.Cell{StyleID: xw.bold, Value: title})
+	}
+	if err := sw.SetRow("A1", header); err != nil {
+		return nil, err
+	}
+
+	xw.stream, xw.row = sw, 1
+	xw.items = append(xw.items, item)
+	return item, nil
+}
+
+// xlsxCell - значение поля с типом колонки: числа - числами, время - датой
+// в стиле date
+func xlsxCell(field Field, v interface{}, date int) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case bool:
+		return v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case string:
+		if strings.HasPrefix(field.Type, "timestamp") || field.Type == "date" {
+			if t, ok := snapshotTime(v); ok {
+				return excelize.Cell{StyleID: date, Value: t}
+			}
+		}
+		return v
+	default:
+		return text(v)
+	}
+}
+
+func (xw *xlsxWriter) Flush() error {
+	// Книга - zip-архив, отдается целиком в Close
+	return nil
+}
+
+func (xw *xlsxWriter) Close() error {
+	defer xw.file.Close()
+
+	if xw.stream != nil {
+		if err := xw.stream.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := xw.summary(); err != nil {
+		return err
+	}
+	return xw.file.Write(xw.out)
+}
+
+// summary заполняет лист Summary: параметры отчета и список товаров
+// со ссылками на их листы
+func (xw *xlsxWriter) summary() error {
+	f, r := xw.file, xw.report
+	row, err := summaryHeader(f, xw.bold, r, [][2]string{
+		{"Period", r.period()},
+		{"Changed fields", xw.fields.String()},
+	})
+	if err != nil {
+		return err
+	}
+
+	row += 2
+	header := []string{"Item ID", "Item Name", "Sheet", "Entries", "First Change", "Last Change"}
+	if err := f.SetSheetRow(summarySheet, fmt.Sprintf("A%d", row), &header); err != nil {
+		return err
+	}
+	if err := f.SetCellStyle(summarySheet, fmt.Sprintf("A%d", row), fmt.Sprintf("F%d", row), xw.bold); err != nil {
+		return err
+	}
+	for _, item := range xw.items {
+		row++
+		values := []interface{}{item.ID, item.Name, item.Sheet, item.Entries, item.First, item.Last}
+		if err := f.SetSheetRow(summarySheet, fmt.Sprintf("A%d", row), &values); err != nil {
+			return err
+		}
+		if err := f.SetCellStyle(summarySheet, fmt.Sprintf("E%d", row), fmt.Sprintf("F%d", row), xw.date); err != nil {
+			return err
+		}
+		link := fmt.Sprintf("'%s'!A1", item.Sheet)
+		if err := f.SetCellHyperLink(summarySheet, fmt.Sprintf("C%d", row), link, "Location"); err != nil {
+			return err
+		}
+	}
+
+	if err := f.SetColWidth(summarySheet, "A", "A", 14); err != nil {
+		return err
+	}
+	if err := f.SetColWidth(summarySheet, "B", "B", 30); err != nil {
+		return err
+	}
+	return f.SetColWidth(summarySheet, "E", "F", 20)
+}
+
+// summaryHeader пишет в начало листа Summary название отчета, кто и когда
+// его составил, params и фильтры; возвращает номер последней строки
+func summaryHeader(f *excelize.File, bold int, r Report, params [][2]string) (int, error) {
+	if err := f.SetCellValue(summarySheet, "A1", r.Title); err != nil {
+		return 0, err
+	}
+	if err := f.SetCellStyle(summarySheet, "A1", "A1", bold); err != nil {
+		return 0, err
+	}
+	rows := [][2]string{
+		{"Generated by", r.GeneratedBy},
+		{"Generated at", r.GeneratedAt.Format(timeLayout)},
+	}
+	rows = append(rows, params...)
+	for _, filter := range r.Filters {
+		rows = append(rows, [2]string{"Filter", filter})
+	}
+	row := 1
+	for _, p := range rows {
+		row++
+		values := []interface{}{p[0], p[1]}
+		if err := f.SetSheetRow(summarySheet, fmt.Sprintf("A%d", row), &values); err != nil {
+			return 0, err
+		}
+	}
+	return row, nil
+}
+
+// xlsxInventoryWriter - текущие товары на листе Inventory (пишется потоково)
+// и лист Summary с параметрами отчета и итогами
+type xlsxInventoryWriter struct {
+	out    io.Writer
+	report Report
+	file   *excelize.File
+	bold   int
+	date   int
+	stream *excelize.StreamWriter
+	row    int
+	totals inventoryTotals
+}
+
+const inventorySheet = "Inventory"
+
+func newXLSXInventory(w io.Writer, r Report) (InventoryWriter, error) {
+	f, bold, date, err := newWorkbook()
+	if err != nil {
+		return nil, err
+	}
+	xw := &xlsxInventoryWriter{out: w, report: r, file: f, bold: bold, date: date, row: 1}
+	if _, err := f.NewSheet(inventorySheet); err != nil {
+		return nil, err
+	}
+	if xw.stream, err = f.NewStreamWriter(inventorySheet); err != nil {
+		return nil, err
+	}
+	if err := xw.stream.SetPanes(&excelize.Panes{
+		Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft",
+	}); err != nil {
+		return nil, err
+	}
+	var header []interface{}
+	for _, field := range r.Fields {
+		header = append(header, excelize.Cell{StyleID: bold, Value: field.Name})
+	}
+	if err := xw.stream.SetRow("A1", header); err != nil {
+		return nil, err
+	}
+	return xw, nil
+}
+
+func (xw *xlsxInventoryWriter) Write(item map[string]interface{}) error {
+	xw.totals.add(item)
+	values := make([]interface{}, len(xw.report.Fields))
+	for i, field := range xw.report.Fields {
+		values[i] = xlsxCell(field, item[field.Name], xw.date)
+	}
+	xw.row++
+	return xw.stream.SetRow(fmt.Sprintf("A%d", xw.row), values)
+}
+
+func (xw *xlsxInventoryWriter) Flush() error {
+	return nil
+}
+
+func (xw *xlsxInventoryWriter) Close() error {
+	defer xw.file.Close()
+
+	if err := xw.stream.Flush(); err != nil {
+		return err
+	}
+	if _, err := summaryHeader(xw.file, xw.bold, xw.report, xw.totals.params()); err != nil {
+		return err
+	}
+	if err := xw.file.SetColWidth(summarySheet, "A", "B", 20); err != nil {
+		return err
+	}
+	return xw.file.Write(xw.out)
+}
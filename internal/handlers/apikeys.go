@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+	"3.7/internal/auth"
+	"3.7/internal/database"
+	"3.7/internal/middleware"
+	"3.7/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// GetAPIKeys возвращает все выданные ключи (без секретов)
+func GetAPIKeys(c *gin.Context) {
+	rows, err := database.DB.Query(`
+		SELECT id, name, key_prefix, username, permissions, COALESCE(created_by, ''),
+			created_at, expires_at, last_used_at, revoked_at
+		FROM api_keys
+		ORDER BY id
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		var k models.APIKey
+		err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Username, (*pq.StringArray)(&k.Permissions),
+			&k.CreatedBy, &k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		keys = append(keys, k)
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+// CreateAPIKey выпускает ключ; открытое значение возвращается только здесь
+func CreateAPIKey(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	var req models.CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, perm := range req.Permissions {
+		if !auth.IsAPIKeyAction(perm) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Permission " + strconv.Quote(perm) + " cannot be granted to an API key",
+				"allowed": auth.APIKeyActions,
+			})
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	if req.Username == "" {
+		req.Username = userClaims.Username
+	}
+	if !userExists(c, req.Username) {
+		return
+	}
+
+	key, prefix, hash, err := auth.NewAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+		return
+	}
+
+	resp := models.CreateAPIKeyResponse{Key: key}
+	err = database.DB.QueryRow(`
+		INSERT INTO api_keys (name, key_prefix, key_hash, username, permissions, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, name, key_prefix, username, permissions, created_by, created_at, expires_at
+	`, req.Name, prefix, hash, req.Username, pq.Array(req.Permissions), userClaims.Username, req.ExpiresAt).
+		Scan(&resp.ID, &resp.Name, &resp.Prefix, &resp.Username, (*pq.StringArray)(&resp.Permissions),
+			&resp.CreatedBy, &resp.CreatedAt, &resp.ExpiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, resp)
+}
+
+// RevokeAPIKey отзывает ключ; запись остается для аудита
+func RevokeAPIKey(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var revokedAt time.Time
+	err = database.DB.QueryRow(`
+		UPDATE api_keys SET revoked_at = COALESCE(revoked_at, NOW())
+		WHERE id = $1
+		RETURNING revoked_at
+	`, id).Scan(&revokedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked", "revoked_at": revokedAt})
+}
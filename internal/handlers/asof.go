@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+	"3.7/internal/database"
+	"3.7/internal/middleware"
+	"3.7/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// snapshotItem - поля товара из снимка new_data записи истории.
+// У снимков до появления версий (миграция 020) версия - 0
+const snapshotItem = `
+	(h.new_data->>'id')::integer,
+	h.new_data->>'name',
+	COALESCE(h.new_data->>'description', ''),
+	(h.new_data->>'quantity')::integer,
+	(h.new_data->>'price')::decimal,
+	COALESCE(h.new_data->>'location', ''),
+	(h.new_data->>'created_at')::timestamp,
+	(h.new_data->>'updated_at')::timestamp,
+	COALESCE(h.new_data->>'created_by', ''),
+	COALESCE((h.new_data->>'version')::integer, 0)`
+
+// parseAsOf разбирает параметр ts: RFC3339 или дата (тогда - конец дня)
+func parseAsOf(c *gin.Context) (time.Time, bool) {
+	ts := c.Query("ts")
+	if ts == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Query parameter ts is required"})
+		return time.Time{}, false
+	}
+	asOf, err := asOfTime(ts, database.Location)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ts, expected RFC3339 timestamp or YYYY-MM-DD"})
+		return time.Time{}, false
+	}
+	return asOf, true
+}
+
+// asOfTime переводит ts в пояс БД. changed_at хранится без пояса, а lib/pq
+// передает время вместе со смещением, которое при сравнении с TIMESTAMP
+// отбрасывается, поэтому часы должны совпадать с часами БД.
+// Дата без времени - конец этого дня в поясе БД.
+func asOfTime(ts string, zone *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, ts); err == nil {
+		return t.In(zone), nil
+	}
+	d, err := time.ParseInLocation("2006-01-02", ts, zone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return d.AddDate(0, 0, 1).Add(-time.Microsecond), nil
+}
+
+// GetItemAsOf восстанавливает состояние товара на момент ts по истории:
+// это снимок new_data последней записи не позже ts (у DELETE он пуст).
+// Зона проверяется и когда товара на этот момент нет: по локации из записи
+// удаления, а если товар еще не создан - из первой его записи. У товара
+// без истории проверять нечего.
+func GetItemAsOf(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	asOf, ok := parseAsOf(c)
+	if !ok {
+		return
+	}
+
+	snapshot := models.ItemSnapshot{ItemID: id, AsOf: asOf}
+	var (
+		historyID int
+		action    string
+		exists    bool
+		location  string
+	)
+	err = database.DB.QueryRow(`
+		SELECT h.id, h.action, h.new_data IS NOT NULL, `+historyLocation("h.")+`
+		FROM item_history h
+		WHERE h.item_id = $1 AND h.changed_at <= $2
+		ORDER BY h.changed_at DESC, h.id DESC
+		LIMIT 1
+	`, id, asOf).Scan(&historyID, &action, &exists, &location)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	known, recorded := err == nil, err == nil
+	if !known {
+		err := database.DB.QueryRow(`
+			SELECT `+historyLocation("")+`
+			FROM item_history
+			WHERE item_id = $1
+			ORDER BY changed_at, id
+			LIMIT 1
+		`, id).Scan(&location)
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		recorded = err == nil
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+	if recorded && !scope.Allows(location) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Location is outside of your scope"})
+		return
+	}
+
+	if known {
+		snapshot.HistoryID = &historyID
+		snapshot.Action = action
+	}
+	if known && exists {
+		var item models.Item
+		err = database.DB.QueryRow(`SELECT `+snapshotItem+` FROM item_history h WHERE h.id = $1`, historyID).
+			Scan(&item.ID, &item.Name, &item.Description, &item.Quantity, &item.Price,
+				&item.Location, &item.CreatedAt, &item.UpdatedAt, &item.CreatedBy, &item.Version)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		snapshot.Exists = true
+		snapshot.Item = &item
+	}
+
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// GetInventoryAsOf восстанавливает весь склад на момент ts: для каждого товара
+// берется последний снимок не позже ts, удаленные к тому времени отбрасываются
+func GetInventoryAsOf(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	asOf, ok := parseAsOf(c)
+	if !ok {
+		return
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+	scopeCond, scopeArgs := scope.Condition("COALESCE(h.new_data->>'location', '')", 2)
+
+	rows, err := database.DB.Query(`
+		SELECT `+snapshotItem+`
+		FROM (
+			SELECT DISTINCT ON (item_id) id, new_data
+			FROM item_history
+			WHERE changed_at <= $1
+			ORDER BY item_id, changed_at DESC, id DESC
+		) h
+		WHERE h.new_data IS NOT NULL`+scopeCond+`
+		ORDER BY 1
+	`, append([]interface{}{asOf}, scopeArgs...)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	inventory := models.InventorySnapshot{AsOf: asOf, Items: []models.Item{}}
+	for rows.Next() {
+		var item models.Item
+		err := rows.Scan(&item.ID, &item.Name, &item.Description, &item.Quantity, &item.Price,
+			&item.Location, &item.CreatedAt, &item.UpdatedAt, &item.CreatedBy, &item.Version)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		inventory.Items = append(inventory.Items, item)
+		inventory.TotalQuantity += item.Quantity
+		inventory.TotalValue += float64(item.Quantity) * item.Price
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	inventory.TotalItems = len(inventory.Items)
+
+	c.JSON(http.StatusOK, inventory)
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAsOfTime(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+
+	cases := []struct {
+		name string
+		ts   string
+		zone *time.Location
+		want string // часы БД, с которыми сравнивается changed_at
+	}{
+		{"utc to utc", "2026-03-01T10:00:00Z", time.UTC, "2026-03-01 10:00:00"},
+		{"offset to utc", "2026-03-01T10:00:00+03:00", time.UTC, "2026-03-01 07:00:00"},
+		{"utc to db zone", "2026-03-01T10:00:00Z", moscow, "2026-03-01 13:00:00"},
+		{"offset to other zone", "2026-03-01T23:30:00-05:00", moscow, "2026-03-02 07:30:00"},
+		{"date is end of day in db zone", "2026-03-01", moscow, "2026-03-01 23:59:59.999999"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := asOfTime(tc.ts, tc.zone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wall := got.Format("2006-01-02 15:04:05.999999"); wall != tc.want {
+				t.Errorf("asOfTime(%q) wall clock = %s, want %s", tc.ts, wall, tc.want)
+			}
+			if got.Location() != tc.zone {
+				t.Errorf("asOfTime(%q) zone = %v, want %v", tc.ts, got.Location(), tc.zone)
+			}
+		})
+	}
+
+	// Момент времени не меняется, меняется только пояс
+	got, _ := asOfTime("2026-03-01T10:00:00+03:00", moscow)
+	if want := time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("instant = %v, want %v", got, want)
+	}
+
+	for _, ts := range []string{"yesterday", "2026-13-01", "2026-03-01 10:00"} {
+		if _, err := asOfTime(ts, time.UTC); err == nil {
+			t.Errorf("asOfTime(%q): want error", ts)
+		}
+	}
+}
@@ -1,39 +1,242 @@
-package database
+package handlers
 
 import (
 	"database/sql"
-	"fmt"
-	"log"
-	"os"
-	_ "github.com/lib/pq"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"3.7/internal/auth"
+	"3.7/internal/database"
+	"3.7/internal/models"
+
+	"github.com/gin-gonic/gin"
 )
 
-var DB *sql.DB
+// dummyHash используется, когда пользователь не найден, чтобы время ответа
+// не выдавало существование логина
+const dummyHash = "$2a$14$UfOa6KMWB5jHiTm7LXuMqemv/TBUiKNDlxCdAKnZUZIXa0H6ZWKPm"
+
+// Login проверяет пароль пользователя и выдает токен с ролью из базы
+func Login(c *gin.Context) {
+	var req models.LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Защита от подбора: пока действует задержка, пароль даже не проверяем
+	wait, err := auth.CheckLogin(req.Username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if wait > 0 {
+		respondTooManyAttempts(c, wait)
+		return
+	}
 
-func Init() error {
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_NAME"),
+	var (
+		user      models.User
+		twoFactor bool
 	)
-	var err error
-	DB, err = sql.Open("postgres", connStr)
+	err = database.DB.QueryRow(`
+		SELECT username, password_hash, role, created_at, disabled_at, totp_enabled_at IS NOT NULL
+		FROM users WHERE username = $1
+	`, req.Username).Scan(&user.Username, &user.PasswordHash, &user.Role, &user.CreatedAt,
+		&user.DisabledAt, &twoFactor)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err == sql.ErrNoRows {
+		auth.CheckPasswordHash(req.Password, dummyHash)
+	}
+	// Отключенная учетная запись неотличима от неверного пароля: иначе по
+	// ответу можно проверить пароль, а успех сбрасывал бы счетчик неудач
+	if err == sql.ErrNoRows || !auth.CheckPasswordHash(req.Password, user.PasswordHash) ||
+		user.DisabledAt != nil {
+		wait, err := auth.RecordLoginFailure(req.Username, c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if wait > 0 {
+			respondTooManyAttempts(c, wait)
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return
+	}
+
+	if err := auth.RecordLoginSuccess(user.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Токены выдаются только после второго фактора
+	challenge, err := loginChallenge(user, twoFactor)
 	if err != nil {
-		return err
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	err = DB.Ping()
+	if challenge != nil {
+		c.JSON(http.StatusOK, challenge)
+		return
+	}
+
+	issueTokens(c, http.StatusOK, user, nil)
+}
+
+// loginChallenge начинает второй шаг входа, если пользователю нужен второй
+// фактор: TOTP включен или обязателен для роли. nil - токены выдаются сразу.
+func loginChallenge(user models.User, twoFactor bool) (*models.TwoFactorChallengeResponse, error) {
+	if !twoFactor && !auth.RequiresTwoFactor(user.Role) {
+		return nil, nil
+	}
+	purpose := auth.ChallengeVerify
+	if !twoFactor {
+		purpose = auth.ChallengeEnroll
+	}
+	challenge, err := auth.CreateLoginChallenge(user.Username, purpose)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Println("Connected to database")
-	return nil
+	return &models.TwoFactorChallengeResponse{
+		TwoFactorRequired: true,
+		SetupRequired:     !twoFactor,
+		Challenge:         challenge,
+		ExpiresIn:         int(auth.LoginChallengeTTL.Seconds()),
+	}, nil
 }
 
-func Close() {
-	if DB != nil {
-		DB.Close()
+// respondTooManyAttempts отвечает 429 с заголовком Retry-After в секундах
+func respondTooManyAttempts(c *gin.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "Too many failed login attempts",
+		"retry_after": seconds,
+	})
+}
+
+// Register создает новую учетную запись с ролью viewer. Если политика роли
+// требует 2FA, вместо токенов выдается промежуточный вход с настройкой TOTP.
+func Register(c *gin.Context) {
+	var req models.RegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
+
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	// Роль всегда viewer: повысить права может только администратор
+	var user models.User
+	err = database.DB.QueryRow(`
+		INSERT INTO users (username, password_hash, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (username) DO NOTHING
+		RETURNING username, role, created_at
+	`, req.Username, hash, models.RoleViewer).Scan(&user.Username, &user.Role, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username already taken"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	challenge, err := loginChallenge(user, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if challenge != nil {
+		c.JSON(http.StatusCreated, challenge)
+		return
+	}
+
+	issueTokens(c, http.StatusCreated, user, nil)
+}
+
+// Refresh обменивает refresh-токен на новую пару токенов (с ротацией)
+func Refresh(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, err := auth.RotateRefreshToken(req.RefreshToken)
+	if errors.Is(err, auth.ErrInvalidRefreshToken) || errors.Is(err, auth.ErrRefreshTokenReused) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respondWithSession(c, http.StatusOK, session, models.User{Username: session.Username, Role: session.Role}, nil)
+}
+
+// Logout отзывает сессию вместе со всеми ее refresh-токенами
+func Logout(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := auth.RevokeSessionByRefreshToken(req.RefreshToken)
+	if errors.Is(err, auth.ErrInvalidRefreshToken) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// issueTokens открывает новую сессию и отвечает парой токенов
+func issueTokens(c *gin.Context, status int, user models.User, recoveryCodes []string) {
+	session, err := auth.CreateSession(user.Username, user.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+	respondWithSession(c, status, session, user, recoveryCodes)
+}
+
+func respondWithSession(c *gin.Context, status int, session *auth.Session, user models.User, recoveryCodes []string) {
+	token, err := auth.GenerateToken(session.Username, session.Role, session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	user.Permissions = auth.RolePermissions(user.Role)
+	c.JSON(status, models.AuthResponse{
+		Token:         token,
+		RefreshToken:  session.RefreshToken,
+		ExpiresIn:     int(auth.AccessTokenTTL.Seconds()),
+		User:          user,
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+// JWKS публикует открытые ключи, которыми другие сервисы проверяют токены
+func JWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": auth.JWKS()})
 }
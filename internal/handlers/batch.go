@@ -0,0 +1,405 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"3.7/internal/auth"
+	"3.7/internal/database"
+	"3.7/internal/middleware"
+	"3.7/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/lib/pq"
+)
+
+var (
+	// errBatchNotApplied откатывает транзакцию пакета, результаты операций
+	// при этом отдаются клиенту
+	errBatchNotApplied = errors.New("batch is not applied")
+	errBatchNotFound   = errors.New("batch not found")
+	errBatchReverted   = errors.New("batch has already been reverted")
+	errBatchIsRevert   = errors.New("a revert batch cannot be reverted")
+)
+
+// batchOpError - ошибка отдельной операции пакета с HTTP-статусом,
+// который вернул бы одиночный запрос
+type batchOpError struct {
+	code    int
+	message string
+}
+
+func (e *batchOpError) Error() string {
+	return e.message
+}
+
+// startBatch создает пакет и помечает им все записи истории до конца транзакции
+func startBatch(tx *sql.Tx, kind, username string, source string, revertedBatchID *string) (string, error) {
+	var id string
+	err := tx.QueryRow(`
+		INSERT INTO item_batches (kind, created_by, source, reverted_batch_id)
+		VALUES ($1, $2, NULLIF($3, ''), $4)
+		RETURNING id::text
+	`, kind, username, source, revertedBatchID).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`SELECT set_config('app.batch_id', $1, true)`, id)
+	return id, err
+}
+
+// finishBatch сохраняет итоговые счетчики пакета
+func finishBatch(tx *sql.Tx, id string, created, updated, deleted int) error {
+	_, err := tx.Exec(`
+		UPDATE item_batches SET created_count = $2, updated_count = $3, deleted_count = $4
+		WHERE id = $1
+	`, id, created, updated, deleted)
+	return err
+}
+
+// BatchItems выполняет список операций create/update/delete в одной транзакции.
+// В режиме atomic первая ошибка отменяет весь пакет, в режиме best_effort
+// каждая операция выполняется в своей точке сохранения и неудачные
+// пропускаются. Права проверяются по каждой операции.
+func BatchItems(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	var req models.BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "atomic"
+	}
+	bestEffort := req.Mode == "best_effort"
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+
+	resp := models.BatchResponse{Mode: req.Mode, Results: make([]models.BatchOperationResult, len(req.Operations))}
+	err := database.WithUser(userClaims.Username, func(tx *sql.Tx) error {
+		batchID, err := startBatch(tx, "BATCH", userClaims.Username, "", nil)
+		if err != nil {
+			return err
+		}
+
+		counts := map[string]int{}
+		for i, op := range req.Operations {
+			result := &resp.Results[i]
+			result.Index, result.Op = i, op.Op
+			if !bestEffort && resp.Failed > 0 {
+				result.Status = "skipped"
+				continue
+			}
+
+			if bestEffort {
+				if _, err := tx.Exec("SAVEPOINT batch_operation"); err != nil {
+					return err
+				}
+			}
+			item, err := runBatchOperation(tx, op, userClaims, scope)
+			if err != nil {
+				code, ok := batchErrorCode(err)
+				if !ok {
+					return err
+				}
+				result.Status, result.Error, result.Code, result.Item = "error", err.Error(), code, item
+				resp.Failed++
+				if bestEffort {
+					if _, err := tx.Exec("ROLLBACK TO SAVEPOINT batch_operation"); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if bestEffort {
+				if _, err := tx.Exec("RELEASE SAVEPOINT batch_operation"); err != nil {
+					return err
+				}
+			}
+			result.Status, result.Item = "ok", item
+			resp.Succeeded++
+			counts[op.Op]++
+		}
+
+		if resp.Succeeded == 0 || (!bestEffort && resp.Failed > 0) {
+			return errBatchNotApplied
+		}
+		if err := finishBatch(tx, batchID, counts["create"], counts["update"], counts["delete"]); err != nil {
+			return err
+		}
+		resp.BatchID = &batchID
+		resp.Applied = true
+		return nil
+	})
+
+	switch {
+	case errors.Is(err, errBatchNotApplied):
+		for i := range resp.Results {
+			if resp.Results[i].Status == "ok" {
+				resp.Results[i].Status = "rolled_back"
+			}
+		}
+		resp.Succeeded = 0
+		c.JSON(http.StatusUnprocessableEntity, resp)
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case resp.Failed > 0:
+		c.JSON(http.StatusMultiStatus, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// runBatchOperation выполняет одну операцию пакета теми же функциями,
+// что и одиночные запросы к товарам
+func runBatchOperation(tx *sql.Tx, op models.BatchOperation, claims *auth.Claims, scope *auth.LocationScope) (*models.Item, error) {
+	if !claims.Can(op.Op) {
+		return nil, &batchOpError{http.StatusForbidden, "Insufficient permissions"}
+	}
+	if op.Op != "create" && op.ID == nil {
+		return nil, &batchOpError{http.StatusBadRequest, "id is required for " + op.Op}
+	}
+
+	var (
+		item models.Item
+		err  error
+	)
+	switch op.Op {
+	case "create":
+		var req models.CreateItemRequest
+		if err := decodeBatchItem(op.Item, &req); err != nil {
+			return nil, err
+		}
+		item, err = insertItem(tx, req, claims.Username, scope)
+	case "update":
+		var req models.UpdateItemRequest
+		if err := decodeBatchItem(op.Item, &req); err != nil {
+			return nil, err
+		}
+		if req.Version == nil {
+			req.Version = op.Version
+		}
+		item, err = updateItem(tx, *op.ID, req, scope, "")
+	case "delete":
+		item, err = deleteItem(tx, *op.ID, scope, "", op.Version)
+	}
+	if errors.Is(err, errItemVersionConflict) {
+		// Как и одиночный запрос, конфликт версий отдает текущий товар
+		return &item, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// decodeBatchItem разбирает и проверяет поле item операции, как ShouldBindJSON
+func decodeBatchItem(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return &batchOpError{http.StatusBadRequest, "item is required"}
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return &batchOpError{http.StatusBadRequest, err.Error()}
+	}
+	if err := binding.Validator.ValidateStruct(v); err != nil {
+		return &batchOpError{http.StatusBadRequest, err.Error()}
+	}
+	return nil
+}
+
+// batchErrorCode - статус ошибки операции; false - ошибка не относится
+// к операции (например, сбой БД) и прерывает весь пакет
+func batchErrorCode(err error) (int, bool) {
+	var opErr *batchOpError
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &opErr):
+		return opErr.code, true
+	case errors.Is(err, errItemNotFound):
+		return http.StatusNotFound, true
+	case errors.Is(err, errItemOutOfScope):
+		return http.StatusForbidden, true
+	case errors.Is(err, errItemVersionRequired):
+		return http.StatusBadRequest, true
+	case errors.Is(err, errItemVersionConflict):
+		return http.StatusConflict, true
+	case errors.As(err, &pqErr) && (pqErr.Code.Class() == "22" || pqErr.Code.Class() == "23"):
+		// Значение не подошло колонке или нарушило ограничение таблицы
+		return http.StatusUnprocessableEntity, true
+	}
+	return 0, false
+}
+
+// GetBatch возвращает пакет изменений и его записи истории в пределах
+// зоны пользователя
+func GetBatch(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	id := c.Param("id")
+	if !validBatchID(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+		return
+	}
+
+	var filter models.HistoryFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.Limit == 0 {
+		filter.Limit = 50
+	}
+	filter.BatchID = &id
+
+	var batch models.ItemBatch
+	err := database.DB.QueryRow(`
+		SELECT b.id::text, b.kind, COALESCE(b.created_by, ''), b.created_at, COALESCE(b.source, ''),
+			b.created_count, b.updated_count, b.deleted_count, b.reverted_batch_id::text,
+			(SELECT r.id::text FROM item_batches r WHERE r.reverted_batch_id = b.id)
+		FROM item_batches b
+		WHERE b.id = $1
+	`, id).Scan(&batch.ID, &batch.Kind, &batch.CreatedBy, &batch.CreatedAt, &batch.Source,
+		&batch.CreatedCount, &batch.UpdatedCount, &batch.DeletedCount, &batch.RevertedBatchID, &batch.RevertedBy)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+	where, args := historyFilterCondition(scope, filter)
+
+	page, err := queryHistoryPage(where, args, filter.Limit, filter.Offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"batch": batch, "history": page})
+}
+
+// RevertBatch откатывает пакет целиком (право revert): записи пакета
+// откатываются от последней к первой в одной транзакции, откат получает
+// свой пакет REVERT. Если хотя бы один товар изменился после пакета,
+// не откатывается ничего.
+func RevertBatch(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	id := c.Param("id")
+	if !validBatchID(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+		return
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+
+	resp := models.BatchRevertResponse{RevertedBatchID: id}
+	var failedEntry int
+	err := database.WithUser(userClaims.Username, func(tx *sql.Tx) error {
+		var kind string
+		var revertedBy *string
+		err := tx.QueryRow(`
+			SELECT kind, (SELECT r.id::text FROM item_batches r WHERE r.reverted_batch_id = b.id)
+			FROM item_batches b
+			WHERE id = $1
+			FOR UPDATE
+		`, id).Scan(&kind, &revertedBy)
+		if err == sql.ErrNoRows {
+			return errBatchNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if kind == "REVERT" {
+			return errBatchIsRevert
+		}
+		if revertedBy != nil {
+			return errBatchReverted
+		}
+
+		rows, err := tx.Query(`SELECT id FROM item_history WHERE batch_id = $1 ORDER BY id DESC`, id)
+		if err != nil {
+			return err
+		}
+		var entries []int
+		for rows.Next() {
+			var entry int
+			if err := rows.Scan(&entry); err != nil {
+				rows.Close()
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		resp.BatchID, err = startBatch(tx, "REVERT", userClaims.Username, "", &id)
+		if err != nil {
+			return err
+		}
+
+		// Счетчики пакета отката - по действию отката: откат создания удаляет товар.
+		// Записи, которые ничего не меняли, не откатываются и не считаются.
+		counts := map[string]int{}
+		resp.Skipped = []int{}
+		for _, entry := range entries {
+			result, err := revertEntry(tx, entry, scope, true, "", nil)
+			if err != nil {
+				failedEntry = entry
+				return err
+			}
+			if result.Noop {
+				resp.Skipped = append(resp.Skipped, entry)
+				continue
+			}
+			counts[result.Action]++
+			resp.Reverted++
+		}
+		return finishBatch(tx, resp.BatchID, counts["DELETE"], counts["UPDATE"], counts["CREATE"])
+	})
+
+	switch {
+	case errors.Is(err, errBatchNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+	case errors.Is(err, errBatchIsRevert):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A revert batch cannot be reverted"})
+	case errors.Is(err, errBatchReverted):
+		c.JSON(http.StatusConflict, gin.H{"error": "Batch has already been reverted"})
+	case errors.Is(err, errRevertOutOfScope):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Location is outside of your scope"})
+	case errors.Is(err, errRevertChangedSince) || errors.Is(err, errRevertItemMissing) ||
+		errors.Is(err, errRevertItemExists) || errors.Is(err, errRevertUnsupported):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":      fmt.Sprintf("History entry %d: %s", failedEntry, err.Error()),
+			"history_id": failedEntry,
+		})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revert: " + err.Error()})
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// validBatchID проверяет, что id пакета - UUID
+func validBatchID(id string) bool {
+	return binding.Validator.Engine().(*validator.Validate).Var(id, "uuid") == nil
+}
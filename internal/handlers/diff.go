@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"3.7/internal/database"
+	"3.7/internal/diff"
+	"3.7/internal/middleware"
+	"3.7/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetItemDiff сравнивает две версии товара: состояния после записей истории
+// from и to либо номера версий from_version и to_version. Без from сравнение
+// идет с состоянием до создания товара, без to - с последней версией.
+func GetItemDiff(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+
+	loadVersion := func(param string) (*models.ItemVersion, map[string]interface{}, bool) {
+		var (
+			version  models.ItemVersion
+			data     string
+			location string
+			err      error
+		)
+		query := `
+			SELECT id, version, action, changed_at, COALESCE(new_data::text, ''), ` + historyLocation("") + `
+			FROM item_history
+			WHERE item_id = $1`
+		if raw := c.Query(param); raw != "" {
+			historyID, convErr := strconv.Atoi(raw)
+			if convErr != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + " history ID"})
+				return nil, nil, false
+			}
+			err = database.DB.QueryRow(query+` AND id = $2`, id, historyID).
+				Scan(&version.HistoryID, &version.Version, &version.Action, &version.ChangedAt, &data, &location)
+		} else if raw := c.Query(param + "_version"); raw != "" {
+			number, convErr := strconv.Atoi(raw)
+			if convErr != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + "_version"})
+				return nil, nil, false
+			}
+			// Удаление сохраняет номер удаленной версии: версия - это состояние
+			// после записи, которая ее создала
+			err = database.DB.QueryRow(query+` AND version = $2 AND action <> 'DELETE' ORDER BY id DESC LIMIT 1`, id, number).
+				Scan(&version.HistoryID, &version.Version, &version.Action, &version.ChangedAt, &data, &location)
+		} else if param == "to" {
+			err = database.DB.QueryRow(query+` ORDER BY changed_at DESC, id DESC LIMIT 1`, id).
+				Scan(&version.HistoryID, &version.Version, &version.Action, &version.ChangedAt, &data, &location)
+		} else {
+			// Состояние до первой записи: товара еще нет
+			return &models.ItemVersion{}, nil, true
+		}
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "History record not found for this item"})
+			return nil, nil, false
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return nil, nil, false
+		}
+		if !scope.Allows(location) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Location is outside of your scope"})
+			return nil, nil, false
+		}
+		snapshot, err := diff.Decode(data)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse history snapshot"})
+			return nil, nil, false
+		}
+		version.Exists = snapshot != nil
+		return &version, snapshot, true
+	}
+
+	from, before, ok := loadVersion("from")
+	if !ok {
+		return
+	}
+	to, after, ok := loadVersion("to")
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, models.ItemDiffResponse{
+		ItemID:  id,
+		From:    *from,
+		To:      *to,
+		Changes: diff.Snapshots(before, after, diff.Items),
+	})
+}
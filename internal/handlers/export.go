@@ -0,0 +1,444 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"3.7/internal/database"
+	"3.7/internal/diff"
+	"3.7/internal/export"
+	"3.7/internal/middleware"
+	"3.7/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Размер порции при выгрузке: история читается курсором по (changed_at, id),
+// поэтому объем выгрузки не ограничен и не держится в памяти целиком
+const exportBatchSize = 500
+
+// ExportHistory выгружает историю товара с учетом всех полей фильтра.
+// Формат задается параметром format: csv (по умолчанию), xlsx, jsonl, pdf.
+func ExportHistory(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	var filter models.HistoryFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.ItemID = &id
+
+	exportHistory(c, filter, fmt.Sprintf("Item #%d history audit report", id),
+		fmt.Sprintf("history_item_%d", id))
+}
+
+// ExportInventoryHistory выгружает историю всего склада в пределах зоны
+// пользователя; в xlsx - лист на каждый товар, в pdf - раздел на товар
+func ExportInventoryHistory(c *gin.Context) {
+	var filter models.HistoryFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	exportHistory(c, filter, "Inventory history audit report", "history")
+}
+
+// exportHistory отдает историю по фильтру в формате из параметра format.
+// Потоковые форматы (csv, jsonl) отправляются порциями по мере чтения.
+func exportHistory(c *gin.Context, filter models.HistoryFilter, title, filename string) {
+	userClaims := middleware.MustGetClaims(c)
+
+	format, ok := export.Lookup(c.Query("format"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format, expected one of: " + export.Names})
+		return
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+	where, args := historyFilterCondition(scope, filter)
+
+	fields, err := itemFields(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exportFits(c, format, historySelect+where, args) {
+		return
+	}
+
+	// Первую порцию читаем до отправки заголовков, чтобы ошибку запроса
+	// еще можно было вернуть в JSON
+	cursor := &historyCursor{where: where, args: args, byItem: format.ByItem}
+	batch, err := cursor.next()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	report := export.Report{
+		Title:       title,
+		GeneratedBy: userClaims.Username,
+		GeneratedAt: now,
+		From:        filter.FromDate,
+		To:          filter.ToDate,
+		Fields:      fields,
+	}
+	if filter.ItemID != nil {
+		report.Filters = append(report.Filters, fmt.Sprintf("Item ID: %d", *filter.ItemID))
+	}
+	if filter.Action != nil {
+		report.Filters = append(report.Filters, "Action: "+*filter.Action)
+	}
+	if filter.ChangedBy != nil {
+		report.Filters = append(report.Filters, "Changed by: "+*filter.ChangedBy)
+	}
+	if filter.BatchID != nil {
+		report.Filters = append(report.Filters, "Batch: "+*filter.BatchID)
+	}
+
+	c.Writer.Header().Set("Content-Type", format.ContentType)
+	c.Writer.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%s_%s.%s", filename, now.Format("20060102_150405"), format.Extension))
+	writer, err := format.Open(c.Writer, report)
+	if err != nil {
+		log.Println("History export:", err)
+		return
+	}
+
+	for len(batch) > 0 {
+		for _, h := range batch {
+			if err := writer.Write(h); err != nil {
+				log.Println("History export:", err)
+				return
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			log.Println("History export:", err)
+			return
+		}
+		c.Writer.Flush()
+
+		if batch, err = cursor.next(); err != nil {
+			// Заголовки уже отправлены: обрываем выгрузку, клиент увидит неполный файл
+			log.Println("History export:", err)
+			return
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		log.Println("History export:", err)
+	}
+}
+
+// historyCursor читает историю порциями: от новых записей к старым или,
+// для выгрузок по товарам, по товарам и внутри товара в хронологическом порядке
+type historyCursor struct {
+	where  string
+	args   []interface{}
+	byItem bool
+	// Ключ последней прочитанной записи; changed_at без часового пояса,
+	// поэтому параметр приводится к timestamp по "настенному" времени
+	lastItem int
+	lastAt   *time.Time
+	lastID   int
+	done     bool
+}
+
+func (hc *historyCursor) next() ([]models.HistoryEntry, error) {
+	if hc.done {
+		return nil, nil
+	}
+
+	where := hc.where
+	args := append([]interface{}{}, hc.args...)
+	order := " ORDER BY h.changed_at DESC, h.id DESC"
+	if hc.byItem {
+		order = " ORDER BY h.item_id, h.changed_at, h.id"
+	}
+	if hc.lastAt != nil {
+		n := len(args) + 1
+		if hc.byItem {
+			where += fmt.Sprintf(" AND (h.item_id, h.changed_at, h.id) > ($%d, $%d::timestamp, $%d)", n, n+1, n+2)
+			args = append(args, hc.lastItem, *hc.lastAt, hc.lastID)
+		} else {
+			where += fmt.Sprintf(" AND (h.changed_at, h.id) < ($%d::timestamp, $%d)", n, n+1)
+			args = append(args, *hc.lastAt, hc.lastID)
+		}
+	}
+	query := historySelect + where + order + fmt.Sprintf(" LIMIT $%d", len(args)+1)
+	args = append(args, exportBatchSize)
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []models.HistoryEntry
+	for rows.Next() {
+		var h models.HistoryEntry
+		err := rows.Scan(
+			&h.ID,
+			&h.ItemID,
+			&h.Action,
+			&h.ChangedBy,
+			&h.ChangedAt,
+			&h.OldData,
+			&h.NewData,
+			&h.RevertedHistoryID,
+			&h.BatchID,
+			&h.Version,
+			&h.ItemName,
+		)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(batch) < exportBatchSize {
+		hc.done = true
+	}
+	if len(batch) > 0 {
+		last := batch[len(batch)-1]
+		hc.lastItem, hc.lastAt, hc.lastID = last.ItemID, &last.ChangedAt, last.ID
+	}
+	return batch, nil
+}
+
+// itemFields - колонки товара для выгрузки: сначала в привычном порядке,
+// затем остальные в порядке таблицы. Для истории служебные колонки
+// пропускаются (service = false), для остатков - выводятся, id первым.
+func itemFields(service bool) ([]export.Field, error) {
+	rows, err := database.DB.Query(`
+		SELECT column_name, data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'items'
+		ORDER BY ordinal_position
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := map[string]string{}
+	var columns []string
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return nil, err
+		}
+		types[name] = dataType
+		columns = append(columns, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var fields []export.Field
+	seen := map[string]bool{}
+	add := func(f string) {
+		if dataType, ok := types[f]; ok && !seen[f] {
+			fields = append(fields, export.Field{Name: f, Type: dataType})
+			seen[f] = true
+		}
+	}
+	if service {
+		add("id")
+	}
+	for _, f := range diff.Items.Order {
+		add(f)
+	}
+	for _, f := range columns {
+		if service || !diff.Items.Ignore[f] {
+			add(f)
+		}
+	}
+	return fields, nil
+}
+
+// exportFits проверяет ограничение формата на число строк: документы
+// собираются в памяти целиком. query - выборка строк выгрузки без ORDER BY.
+func exportFits(c *gin.Context, format *export.Format, query string, args []interface{}) bool {
+	if format.MaxRows == 0 {
+		return true
+	}
+	var count int
+	err := database.DB.QueryRow(
+		fmt.Sprintf("SELECT COUNT(*) FROM (%s LIMIT $%d) t", query, len(args)+1),
+		append(append([]interface{}{}, args...), format.MaxRows+1)...,
+	).Scan(&count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if count > format.MaxRows {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": fmt.Sprintf("The %s export is limited to %d rows, narrow the filter or use csv or jsonl",
+				format.Name, format.MaxRows),
+			"limit": format.MaxRows,
+		})
+		return false
+	}
+	return true
+}
+
+// ExportInventory выгружает текущие товары в пределах зоны пользователя
+// с фильтрами списка товаров (GET /items); формат - параметр format
+func ExportInventory(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	var filter models.ItemFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	format, ok := export.Lookup(c.Query("format"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format, expected one of: " + export.Names})
+		return
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+	where, args := itemFilterCondition(scope, filter)
+
+	fields, err := itemFields(true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exportFits(c, format, "SELECT id FROM items WHERE 1=1"+where, args) {
+		return
+	}
+
+	cursor := &inventoryCursor{where: where, args: args}
+	batch, err := cursor.next()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	report := export.Report{
+		Title:       "Inventory report",
+		GeneratedBy: userClaims.Username,
+		GeneratedAt: now,
+		Fields:      fields,
+	}
+	if filter.Location != nil {
+		report.Filters = append(report.Filters, "Location: "+*filter.Location)
+	}
+	if filter.CreatedBy != nil {
+		report.Filters = append(report.Filters, "Created by: "+*filter.CreatedBy)
+	}
+	if filter.MinQuantity != nil {
+		report.Filters = append(report.Filters, fmt.Sprintf("Quantity from: %d", *filter.MinQuantity))
+	}
+	if filter.MaxQuantity != nil {
+		report.Filters = append(report.Filters, fmt.Sprintf("Quantity to: %d", *filter.MaxQuantity))
+	}
+	if filter.MinPrice != nil {
+		report.Filters = append(report.Filters, fmt.Sprintf("Price from: %g", *filter.MinPrice))
+	}
+	if filter.MaxPrice != nil {
+		report.Filters = append(report.Filters, fmt.Sprintf("Price to: %g", *filter.MaxPrice))
+	}
+	if filter.Q != "" {
+		report.Filters = append(report.Filters, "Search: "+filter.Q)
+	}
+
+	c.Writer.Header().Set("Content-Type", format.ContentType)
+	c.Writer.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=inventory_%s.%s", now.Format("20060102_150405"), format.Extension))
+	writer, err := format.OpenInventory(c.Writer, report)
+	if err != nil {
+		log.Println("Inventory export:", err)
+		return
+	}
+
+	for len(batch) > 0 {
+		for _, item := range batch {
+			if err := writer.Write(item); err != nil {
+				log.Println("Inventory export:", err)
+				return
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			log.Println("Inventory export:", err)
+			return
+		}
+		c.Writer.Flush()
+
+		if batch, err = cursor.next(); err != nil {
+			log.Println("Inventory export:", err)
+			return
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		log.Println("Inventory export:", err)
+	}
+}
+
+// inventoryCursor читает товары порциями по возрастанию id в виде снимков
+// to_jsonb, так что новые колонки items попадают в выгрузку без изменений кода
+type inventoryCursor struct {
+	where  string
+	args   []interface{}
+	lastID int
+	done   bool
+}
+
+func (ic *inventoryCursor) next() ([]map[string]interface{}, error) {
+	if ic.done {
+		return nil, nil
+	}
+
+	args := append([]interface{}{}, ic.args...)
+	n := len(args) + 1
+	query := "SELECT id, to_jsonb(items)::text FROM items WHERE 1=1" + ic.where +
+		fmt.Sprintf(" AND id > $%d ORDER BY id LIMIT $%d", n, n+1)
+	rows, err := database.DB.Query(query, append(args, ic.lastID, exportBatchSize)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []map[string]interface{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&ic.lastID, &data); err != nil {
+			return nil, err
+		}
+		item, err := diff.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(batch) < exportBatchSize {
+		ic.done = true
+	}
+	return batch, nil
+}
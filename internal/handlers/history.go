@@ -1,26 +1,28 @@
 package handlers
 
 import (
-	"encoding/csv"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
-	"warehouse-system/internal/auth"
-	"warehouse-system/internal/database"
-	"warehouse-system/internal/models"
+	"3.7/internal/auth"
+	"3.7/internal/database"
+	"3.7/internal/diff"
+	"3.7/internal/middleware"
+	"3.7/internal/models"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 )
 
 // GetHistory возвращает историю изменений с фильтрацией
 func GetHistory(c *gin.Context) {
-	claims, _ := c.Get("claims")
-	userClaims := claims.(*auth.Claims)
-	if !auth.HasPermission(userClaims.Role, "history") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
-		return
-	}
+	userClaims := middleware.MustGetClaims(c)
 
 	var filter models.HistoryFilter
 	if err := c.ShouldBindQuery(&filter); err != nil {
@@ -32,75 +34,115 @@ func GetHistory(c *gin.Context) {
 		filter.Limit = 50
 	}
 
-	// Построение динамического запроса
-	query := `
-		SELECT 
-			h.id, 
-			h.item_id, 
-			h.action, 
-			h.changed_by, 
-			h.changed_at, 
-			h.old_data, 
-			h.new_data, 
-			h.changes,
-			i.name as item_name
-		FROM item_history h
-		LEFT JOIN items i ON h.item_id = i.id
-		WHERE 1=1
-	`
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+	where, args := historyFilterCondition(scope, filter)
+
+	page, err := queryHistoryPage(where, args, filter.Limit, filter.Offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// historyFilterCondition собирает условия WHERE (с алиасом h) по зоне
+// пользователя и всем полям фильтра, кроме limit/offset
+func historyFilterCondition(scope *auth.LocationScope, filter models.HistoryFilter) (string, []interface{}) {
+	where := ""
 	args := []interface{}{}
 	argCount := 1
 
+	scopeCond, scopeArgs := scope.Condition(historyLocation("h."), argCount)
+	where += scopeCond
+	args = append(args, scopeArgs...)
+	argCount += len(scopeArgs)
+
 	if filter.ItemID != nil {
-		query += fmt.Sprintf(" AND h.item_id = $%d", argCount)
+		where += fmt.Sprintf(" AND h.item_id = $%d", argCount)
 		args = append(args, *filter.ItemID)
 		argCount++
 	}
 
 	if filter.ChangedBy != nil {
-		query += fmt.Sprintf(" AND h.changed_by = $%d", argCount)
+		where += fmt.Sprintf(" AND h.changed_by = $%d", argCount)
 		args = append(args, *filter.ChangedBy)
 		argCount++
 	}
 
 	if filter.Action != nil {
-		query += fmt.Sprintf(" AND h.action = $%d", argCount)
+		where += fmt.Sprintf(" AND h.action = $%d", argCount)
 		args = append(args, *filter.Action)
 		argCount++
 	}
 
 	if filter.FromDate != nil {
-		query += fmt.Sprintf(" AND h.changed_at >= $%d", argCount)
+		where += fmt.Sprintf(" AND h.changed_at >= $%d", argCount)
 		args = append(args, *filter.FromDate)
 		argCount++
 	}
 
 	if filter.ToDate != nil {
-		query += fmt.Sprintf(" AND h.changed_at <= $%d", argCount)
+		where += fmt.Sprintf(" AND h.changed_at <= $%d", argCount)
 		args = append(args, *filter.ToDate)
 		argCount++
 	}
 
-	query += fmt.Sprintf(" ORDER BY h.changed_at DESC LIMIT $%d OFFSET $%d", argCount, argCount+1)
-	args = append(args, filter.Limit, filter.Offset)
+	if filter.BatchID != nil {
+		where += fmt.Sprintf(" AND h.batch_id = $%d", argCount)
+		args = append(args, *filter.BatchID)
+	}
 
-	rows, err := database.DB.Query(query, args...)
+	return where, args
+}
+
+// historySelect - общий SELECT записей истории; NULL в jsonb-полях
+// (old_data у CREATE, new_data у DELETE) и неизвестный автор отдаются пустой строкой
+const historySelect = `
+	SELECT 
+		h.id, 
+		h.item_id, 
+		h.action, 
+		COALESCE(h.changed_by, ''), 
+		h.changed_at, 
+		COALESCE(h.old_data::text, ''), 
+		COALESCE(h.new_data::text, ''), 
+		h.reverted_history_id,
+		h.batch_id::text,
+		h.version,
+		COALESCE(i.name, h.old_data->>'name', '') as item_name
+	FROM item_history h
+	LEFT JOIN items i ON h.item_id = i.id
+	WHERE 1=1`
+
+// queryHistoryPage выбирает страницу истории по условиям where (с алиасом h)
+// и считает общее число подходящих записей
+func queryHistoryPage(where string, args []interface{}, limit, offset int) (*models.HistoryPage, error) {
+	page := &models.HistoryPage{History: []models.HistoryEntry{}, Limit: limit, Offset: offset}
+
+	err := database.DB.QueryRow(`
+		SELECT COUNT(*)
+		FROM item_history h
+		LEFT JOIN items i ON h.item_id = i.id
+		WHERE 1=1`+where, args...).Scan(&page.Total)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
-	defer rows.Close()
 
-	var history []struct {
-		models.ItemHistory
-		ItemName string `json:"item_name"`
+	argCount := len(args) + 1
+	query := historySelect + where +
+		fmt.Sprintf(" ORDER BY h.changed_at DESC, h.id DESC LIMIT $%d OFFSET $%d", argCount, argCount+1)
+	rows, err := database.DB.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		var h struct {
-			models.ItemHistory
-			ItemName string `json:"item_name"`
-		}
+		var h models.HistoryEntry
 		err := rows.Scan(
 			&h.ID,
 			&h.ItemID,
@@ -109,187 +151,46 @@ func GetHistory(c *gin.Context) {
 			&h.ChangedAt,
 			&h.OldData,
 			&h.NewData,
-			&h.Changes,
+			&h.RevertedHistoryID,
+			&h.BatchID,
+			&h.Version,
 			&h.ItemName,
 		)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return nil, err
+		}
+		if err := setHistoryChanges(&h.ItemHistory); err != nil {
+			return nil, err
 		}
-		history = append(history, h)
+		page.History = append(page.History, h)
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"history": history,
-		"total":   len(history),
-		"limit":   filter.Limit,
-		"offset":  filter.Offset,
-	})
+	return page, rows.Err()
 }
 
-// ExportHistory экспортирует историю в CSV
-func ExportHistory(c *gin.Context) {
-	claims, _ := c.Get("claims")
-	userClaims := claims.(*auth.Claims)
-	if !auth.HasPermission(userClaims.Role, "history") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
-		return
-	}
-
-	itemID := c.Param("id")
-	if itemID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Item ID is required"})
-		return
-	}
-
-	// Преобразуем ID в число
-	id, err := strconv.Atoi(itemID)
+// setHistoryChanges заполняет changes записи по ее снимкам: изменения
+// считает только пакет diff, в БД хранятся лишь снимки
+func setHistoryChanges(h *models.ItemHistory) error {
+	diffs, err := diff.Rows(h.OldData, h.NewData, diff.Items)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
-		return
+		return fmt.Errorf("history entry %d: %w", h.ID, err)
 	}
-
-	var filter models.HistoryFilter
-	if err := c.ShouldBindQuery(&filter); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	filter.ItemID = &id
-	if filter.Limit == 0 {
-		filter.Limit = 1000 // Большой лимит для экспорта
-	}
-
-	// Получаем историю
-	rows, err := database.DB.Query(`
-		SELECT 
-			h.id,
-			h.item_id,
-			h.action,
-			h.changed_by,
-			h.changed_at,
-			h.old_data,
-			h.new_data,
-			h.changes,
-			i.name as item_name
-		FROM item_history h
-		LEFT JOIN items i ON h.item_id = i.id
-		WHERE h.item_id = $1
-		ORDER BY h.changed_at DESC
-		LIMIT $2
-	`, id, filter.Limit)
+	changes, err := json.Marshal(diff.Changes(diffs))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-	defer rows.Close()
-
-	// Создаем CSV writer
-	c.Writer.Header().Set("Content-Type", "text/csv")
-	c.Writer.Header().Set("Content-Disposition", 
-		fmt.Sprintf("attachment; filename=history_item_%s_%s.csv", 
-			itemID, time.Now().Format("20060102_150405")))
-	writer := csv.NewWriter(c.Writer)
-	defer writer.Flush()
-
-	// Записываем заголовки
-	headers := []string{
-		"ID",
-		"Item ID",
-		"Item Name",
-		"Action",
-		"Changed By",
-		"Changed At",
-		"Old Data",
-		"New Data",
-		"Changes",
-		"Changed Fields Count",
-	}
-	if err := writer.Write(headers); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write CSV"})
-		return
-	}
-
-	// Записываем данные
-	for rows.Next() {
-		var (
-			historyID int
-			itemID    int
-			action    string
-			changedBy string
-			changedAt time.Time
-			oldData   string
-			newData   string
-			changes   string
-			itemName  string
-		)
-
-		err := rows.Scan(
-			&historyID,
-			&itemID,
-			&action,
-			&changedBy,
-			&changedAt,
-			&oldData,
-			&newData,
-			&changes,
-			&itemName,
-		)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		// Подсчитываем количество измененных полей
-		changedFields := 0
-		if changes != "" {
-			// Простой подсчет - считаем количество двоеточий в JSON (приблизительно)
-			// В реальном приложении нужно парсить JSON
-			for i := 0; i < len(changes); i++ {
-				if changes[i] == ':' {
-					changedFields++
-				}
-			}
-			// Примерно: 2 символа на поле в минимальном JSON
-			if changedFields > 0 {
-				changedFields /= 2
-			}
-		}
-
-		record := []string{
-			strconv.Itoa(historyID),
-			strconv.Itoa(itemID),
-			itemName,
-			action,
-			changedBy,
-			changedAt.Format("2006-01-02 15:04:05"),
-			oldData,
-			newData,
-			changes,
-			strconv.Itoa(changedFields),
-		}
-
-		if err := writer.Write(record); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write CSV row"})
-			return
-		}
-	}
-
-	// Проверяем ошибки итерации
-	if err := rows.Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return err
 	}
+	h.Changes = string(changes)
+	return nil
 }
 
 // GetHistoryStats возвращает статистику по истории
 func GetHistoryStats(c *gin.Context) {
-	claims, _ := c.Get("claims")
-	userClaims := claims.(*auth.Claims)
-	if !auth.HasPermission(userClaims.Role, "history") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+	userClaims := middleware.MustGetClaims(c)
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
 		return
 	}
+	scopeCond, scopeArgs := scope.Condition(historyLocation(""), 1)
 
 	// Статистика по действиям
 	rows, err := database.DB.Query(`
@@ -300,9 +201,10 @@ func GetHistoryStats(c *gin.Context) {
 			MIN(changed_at) as first_change,
 			MAX(changed_at) as last_change
 		FROM item_history
+		WHERE 1=1`+scopeCond+`
 		GROUP BY action
 		ORDER BY count DESC
-	`)
+	`, scopeArgs...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -317,7 +219,7 @@ func GetHistoryStats(c *gin.Context) {
 		LastChange   time.Time `json:"last_change"`
 	}
 
-	var stats []ActionStats
+	stats := []ActionStats{}
 	for rows.Next() {
 		var s ActionStats
 		err := rows.Scan(&s.Action, &s.Count, &s.UniqueUsers, &s.FirstChange, &s.LastChange)
@@ -331,15 +233,16 @@ func GetHistoryStats(c *gin.Context) {
 	// Статистика по пользователям
 	userRows, err := database.DB.Query(`
 		SELECT 
-			changed_by,
+			COALESCE(changed_by, '') as changed_by,
 			COUNT(*) as change_count,
 			COUNT(DISTINCT item_id) as items_affected,
 			STRING_AGG(DISTINCT action, ', ') as actions_performed
 		FROM item_history
-		GROUP BY changed_by
+		WHERE 1=1`+scopeCond+`
+		GROUP BY 1
 		ORDER BY change_count DESC
 		LIMIT 10
-	`)
+	`, scopeArgs...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -353,7 +256,7 @@ func GetHistoryStats(c *gin.Context) {
 		Actions       string `json:"actions"`
 	}
 
-	var userStats []UserStats
+	userStats := []UserStats{}
 	for userRows.Next() {
 		var u UserStats
 		err := userRows.Scan(&u.Username, &u.ChangeCount, &u.ItemsAffected, &u.Actions)
@@ -364,23 +267,16 @@ func GetHistoryStats(c *gin.Context) {
 		userStats = append(userStats, u)
 	}
 
-	// Общая статистика
-	var totalChanges int
-	err = database.DB.QueryRow("SELECT COUNT(*) FROM item_history").Scan(&totalChanges)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	var firstRecord time.Time
-	err = database.DB.QueryRow("SELECT MIN(changed_at) FROM item_history").Scan(&firstRecord)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	var lastRecord time.Time
-	err = database.DB.QueryRow("SELECT MAX(changed_at) FROM item_history").Scan(&lastRecord)
+	// Общая статистика (на пустой истории MIN/MAX дают NULL)
+	var (
+		totalChanges int
+		firstRecord  *time.Time
+		lastRecord   *time.Time
+	)
+	err = database.DB.QueryRow(`
+		SELECT COUNT(*), MIN(changed_at), MAX(changed_at)
+		FROM item_history
+		WHERE 1=1`+scopeCond, scopeArgs...).Scan(&totalChanges, &firstRecord, &lastRecord)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -397,12 +293,7 @@ func GetHistoryStats(c *gin.Context) {
 
 // SearchHistory расширенный поиск по истории
 func SearchHistory(c *gin.Context) {
-	claims, _ := c.Get("claims")
-	userClaims := claims.(*auth.Claims)
-	if !auth.HasPermission(userClaims.Role, "history") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
-		return
-	}
+	userClaims := middleware.MustGetClaims(c)
 
 	type SearchRequest struct {
 		Query      string    `form:"q"`
@@ -411,7 +302,7 @@ func SearchHistory(c *gin.Context) {
 		ToDate     time.Time `form:"to_date"`
 		Actions    []string  `form:"actions[]"`
 		Users      []string  `form:"users[]"`
-		Limit      int       `form:"limit" binding:"min=1,max=500"`
+		Limit      int       `form:"limit" binding:"omitempty,min=1,max=500"`
 		Offset     int       `form:"offset" binding:"min=0"`
 	}
 
@@ -425,28 +316,23 @@ func SearchHistory(c *gin.Context) {
 		req.Limit = 50
 	}
 
-	query := `
-		SELECT 
-			h.id,
-			h.item_id,
-			h.action,
-			h.changed_by,
-			h.changed_at,
-			h.old_data,
-			h.new_data,
-			h.changes,
-			i.name as item_name
-		FROM item_history h
-		LEFT JOIN items i ON h.item_id = i.id
-		WHERE 1=1
-	`
+	where := ""
 	args := []interface{}{}
 	argCount := 1
 
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+	scopeCond, scopeArgs := scope.Condition(historyLocation("h."), argCount)
+	where += scopeCond
+	args = append(args, scopeArgs...)
+	argCount += len(scopeArgs)
+
 	// Текстовый поиск
 	if req.Query != "" {
-		query += fmt.Sprintf(` AND (
-			i.name ILIKE $%d OR
+		where += fmt.Sprintf(` AND (
+			COALESCE(i.name, h.old_data->>'name') ILIKE $%d OR
 			h.changed_by ILIKE $%d OR
 			h.old_data::text ILIKE $%d OR
 			h.new_data::text ILIKE $%d
@@ -457,212 +343,354 @@ func SearchHistory(c *gin.Context) {
 
 	// Поиск по названию товара
 	if req.ItemName != "" {
-		query += fmt.Sprintf(" AND i.name ILIKE $%d", argCount)
+		where += fmt.Sprintf(" AND COALESCE(i.name, h.old_data->>'name') ILIKE $%d", argCount)
 		args = append(args, "%"+req.ItemName+"%")
 		argCount++
 	}
 
 	// По дате
 	if !req.FromDate.IsZero() {
-		query += fmt.Sprintf(" AND h.changed_at >= $%d", argCount)
+		where += fmt.Sprintf(" AND h.changed_at >= $%d", argCount)
 		args = append(args, req.FromDate)
 		argCount++
 	}
 
 	if !req.ToDate.IsZero() {
-		query += fmt.Sprintf(" AND h.changed_at <= $%d", argCount)
+		where += fmt.Sprintf(" AND h.changed_at <= $%d", argCount)
 		args = append(args, req.ToDate)
 		argCount++
 	}
 
 	// По действиям
 	if len(req.Actions) > 0 {
-		query += fmt.Sprintf(" AND h.action = ANY($%d)", argCount)
-		args = append(args, req.Actions)
+		where += fmt.Sprintf(" AND h.action = ANY($%d)", argCount)
+		args = append(args, pq.Array(req.Actions))
 		argCount++
 	}
 
 	// По пользователям
 	if len(req.Users) > 0 {
-		query += fmt.Sprintf(" AND h.changed_by = ANY($%d)", argCount)
-		args = append(args, req.Users)
+		where += fmt.Sprintf(" AND h.changed_by = ANY($%d)", argCount)
+		args = append(args, pq.Array(req.Users))
 		argCount++
 	}
 
-	query += fmt.Sprintf(" ORDER BY h.changed_at DESC LIMIT $%d OFFSET $%d", argCount, argCount+1)
-	args = append(args, req.Limit, req.Offset)
-
-	rows, err := database.DB.Query(query, args...)
+	page, err := queryHistoryPage(where, args, req.Limit, req.Offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
 
-	var history []struct {
-		models.ItemHistory
-		ItemName string `json:"item_name"`
+	c.JSON(http.StatusOK, page)
+}
+
+var (
+	errRevertNotFound     = errors.New("history record not found")
+	errRevertUnsupported  = errors.New("only UPDATE and DELETE actions can be reverted")
+	errRevertNoOldData    = errors.New("no old data available for revert")
+	errRevertItemMissing  = errors.New("item no longer exists, revert its deletion first")
+	errRevertItemExists   = errors.New("item with this ID already exists")
+	errRevertOutOfScope   = errors.New("location is outside of scope")
+	errRevertNothing      = errors.New("history entry has no field changes to revert")
+	errRevertChangedSince = errors.New("item has changed since this entry")
+)
+
+// revertResult - итог отката одной записи истории
+type revertResult struct {
+	ItemID int
+	Action string
+	// Товар после отката; nil, если откат создания удалил товар
+	Item *models.Item
+	// Запись REVERT, которую написал триггер
+	HistoryID int
+	Restored  []string
+	// Запись пакета ничего не меняла: товар не тронут, записи REVERT нет
+	Noop bool
+}
+
+// RevertChange откатывает изменение (право revert). UPDATE откатывает только
+// поля, измененные записью (если их меняли позже - 409), DELETE восстанавливает
+// товар с прежним ID. Как и при других изменениях, клиент передает ожидаемую
+// версию товара (?version= или If-Match): для отката удаления - версию
+// удаленного товара.
+// Все выполняется в одной транзакции: запись REVERT пишет триггер истории
+// со ссылкой на отмененную запись.
+func RevertChange(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	historyID, err := strconv.Atoi(c.Param("history_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid history ID"})
+		return
 	}
 
-	for rows.Next() {
-		var h struct {
-			models.ItemHistory
-			ItemName string `json:"item_name"`
-		}
-		err := rows.Scan(
-			&h.ID,
-			&h.ItemID,
-			&h.Action,
-			&h.ChangedBy,
-			&h.ChangedAt,
-			&h.OldData,
-			&h.NewData,
-			&h.Changes,
-			&h.ItemName,
-		)
+	var version *int
+	if raw := c.Query("version"); raw != "" {
+		v, err := strconv.Atoi(raw)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
 			return
 		}
-		history = append(history, h)
+		version = &v
 	}
-
-	// Получаем общее количество для пагинации
-	countQuery := `
-		SELECT COUNT(*)
-		FROM item_history h
-		LEFT JOIN items i ON h.item_id = i.id
-		WHERE 1=1
-	`
-	countArgs := args[:len(args)-2] // Убираем LIMIT и OFFSET
-	// Копируем условия без LIMIT/OFFSET
-	countQuery += query[len("SELECT ... FROM item_history h LEFT JOIN items i ON h.item_id = i.id WHERE 1=1"):
-		len(query)-len(fmt.Sprintf(" ORDER BY h.changed_at DESC LIMIT $%d OFFSET $%d", argCount, argCount+1))]
-
-	var total int
-	err = database.DB.QueryRow(countQuery, countArgs...).Scan(&total)
-	if err != nil {
-		// Если не удалось посчитать, просто возвращаем результаты
-		c.JSON(http.StatusOK, gin.H{
-			"history": history,
-			"total":   len(history),
-			"limit":   req.Limit,
-			"offset":  req.Offset,
-		})
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" && version == nil {
+		respondItemError(c, errItemVersionRequired)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"history": history,
-		"total":   total,
-		"limit":   req.Limit,
-		"offset":  req.Offset,
-	})
-}
-
-// RevertChange откатывает изменение (только для админов)
-func RevertChange(c *gin.Context) {
-	claims, _ := c.Get("claims")
-	userClaims := claims.(*auth.Claims)
-	if userClaims.Role != models.RoleAdmin {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can revert changes"})
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
 		return
 	}
 
-	historyID := c.Param("history_id")
-	if historyID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "History ID is required"})
+	var result *revertResult
+	err = database.WithUser(userClaims.Username, func(tx *sql.Tx) error {
+		result, err = revertEntry(tx, historyID, scope, false, ifMatch, version)
+		return err
+	})
+	switch {
+	case errors.Is(err, errItemModified):
+		respondItemError(c, err)
+		return
+	case errors.Is(err, errItemVersionConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": "Item has been changed by someone else"})
+		return
+	case errors.Is(err, errRevertNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "History record not found"})
+		return
+	case errors.Is(err, errRevertOutOfScope):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Location is outside of your scope"})
+		return
+	case errors.Is(err, errRevertUnsupported):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only UPDATE and DELETE actions can be reverted"})
+		return
+	case errors.Is(err, errRevertNoOldData):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No old data available for revert"})
+		return
+	case errors.Is(err, errRevertItemMissing) || errors.Is(err, errRevertItemExists) ||
+		errors.Is(err, errRevertNothing) || errors.Is(err, errRevertChangedSince):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revert: " + err.Error()})
 		return
 	}
 
-	// Получаем запись истории
+	c.JSON(http.StatusOK, gin.H{
+		"message":             "Change reverted successfully",
+		"item":                result.Item,
+		"action":              result.Action,
+		"reverted_history_id": historyID,
+		"history_id":          result.HistoryID,
+		"restored_fields":     result.Restored,
+	})
+}
+
+// revertEntry откатывает запись истории в транзакции tx. UPDATE откатывается
+// к значениям до изменения, DELETE восстанавливает товар с прежним ID.
+// При откате пакета (inBatch) откатывается и CREATE (товар удаляется), а товар
+// должен быть в том состоянии, в котором его оставила запись: иначе откат
+// затер бы изменения, сделанные после пакета. Непустые ifMatch и version
+// сверяются с текущей версией товара (для DELETE - с версией удаленного).
+func revertEntry(tx *sql.Tx, historyID int, scope *auth.LocationScope, inBatch bool,
+	ifMatch string, version *int) (*revertResult, error) {
 	var (
-		itemID   int
-		oldData  string
-		action   string
-		itemName string
+		oldData     string
+		newData     string
+		location    string
+		oldLocation string
 	)
-	err := database.DB.QueryRow(`
-		SELECT h.item_id, h.old_data, h.action, i.name
-		FROM item_history h
-		LEFT JOIN items i ON h.item_id = i.id
-		WHERE h.id = $1
-	`, historyID).Scan(&itemID, &oldData, &action, &itemName)
+	result := &revertResult{}
+	err := tx.QueryRow(`
+		SELECT item_id, COALESCE(old_data::text, ''), COALESCE(new_data::text, ''), action,
+			`+historyLocation("")+`, COALESCE(old_data->>'location', '')
+		FROM item_history
+		WHERE id = $1
+	`, historyID).Scan(&result.ItemID, &oldData, &newData, &result.Action, &location, &oldLocation)
+	if err == sql.ErrNoRows {
+		return nil, errRevertNotFound
+	}
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "History record not found"})
-		return
+		return nil, err
 	}
+	action := result.Action
 
-	// Проверяем, можно ли откатить
-	if action != "UPDATE" && action != "DELETE" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Only UPDATE and DELETE actions can be reverted"})
-		return
+	// Откат не должен выводить товар за пределы зоны пользователя
+	if !scope.Allows(location) || !scope.Allows(oldLocation) {
+		return nil, errRevertOutOfScope
 	}
 
-	if oldData == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No old data available for revert"})
-		return
+	if action != "UPDATE" && action != "DELETE" && !(inBatch && action == "CREATE") {
+		return nil, errRevertUnsupported
 	}
 
-	// Для UPDATE: восстанавливаем старые значения
-	if action == "UPDATE" {
-		// Парсим старые данные и обновляем товар
-		// В реальном приложении нужно аккуратно обработать JSON
-		_, err := database.DB.Exec(`
-			UPDATE items 
-			SET 
-				name = (old_data->>'name')::text,
-				description = (old_data->>'description')::text,
-				quantity = (old_data->>'quantity')::integer,
-				price = (old_data->>'price')::decimal,
-				location = (old_data->>'location')::text,
-				updated_at = NOW(),
-				created_by = $2
-			WHERE id = $1
-		`, itemID, userClaims.Username)
+	prior, err := diff.Decode(oldData)
+	if err != nil {
+		return nil, err
+	}
+	if prior == nil && action != "CREATE" {
+		return nil, errRevertNoOldData
+	}
+	after, err := diff.Decode(newData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Триггер пишет запись REVERT только для реального изменения товара:
+	// пометка ставится непосредственно перед ним
+	markRevert := func() error {
+		_, err := tx.Exec(`
+			SELECT set_config('app.history_action', 'REVERT', true),
+				set_config('app.reverted_history_id', $1, true)
+		`, strconv.Itoa(historyID))
+		return err
+	}
+
+	// Колонки берутся из снимков, а значения приводятся к типам колонок
+	// через jsonb_populate_record, так что откат не зависит от набора полей
+	var res sql.Result
+	if action == "UPDATE" || action == "CREATE" {
+		// С момента изменения товар мог переехать: текущая локация тоже
+		// должна быть в зоне пользователя
+		var currentData string
+		err := tx.QueryRow(`
+			SELECT to_jsonb(i)::text FROM items i WHERE id = $1 FOR UPDATE
+		`, result.ItemID).Scan(&currentData)
+		if err == sql.ErrNoRows {
+			return nil, errRevertItemMissing
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revert: " + err.Error()})
-			return
+			return nil, err
 		}
-	} 
-	// Для DELETE: восстанавливаем удаленный товар
-	else if action == "DELETE" {
-		_, err := database.DB.Exec(`
-			INSERT INTO items (name, description, quantity, price, location, created_by)
-			SELECT 
-				(old_data->>'name')::text,
-				(old_data->>'description')::text,
-				(old_data->>'quantity')::integer,
-				(old_data->>'price')::decimal,
-				(old_data->>'location')::text,
-				$2
-			FROM item_history
-			WHERE id = $1
-		`, historyID, userClaims.Username)
+		current, err := diff.Decode(currentData)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore: " + err.Error()})
-			return
+			return nil, err
+		}
+		currentLocation, _ := current["location"].(string)
+		if !scope.Allows(currentLocation) {
+			return nil, errRevertOutOfScope
 		}
+		if inBatch && len(diff.Snapshots(current, after, diff.Items)) > 0 {
+			return nil, errRevertChangedSince
+		}
+		err = checkItemVersion(models.Item{ID: result.ItemID, Version: snapshotVersion(current)}, ifMatch, version)
+		if err != nil {
+			return nil, err
+		}
+
+		if action == "CREATE" {
+			if err := markRevert(); err != nil {
+				return nil, err
+			}
+			res, err = tx.Exec(`DELETE FROM items WHERE id = $1`, result.ItemID)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// Восстанавливаем только поля, которые изменила запись; колонки,
+			// которых нет в одном из снимков, не трогаем. Если поле меняли
+			// после записи, откат затер бы более новое значение (например,
+			// движение остатка) - такой откат отклоняется.
+			var set []string
+			for _, d := range diff.Snapshots(prior, after, diff.Items) {
+				_, inCurrent := current[d.Field]
+				_, inPrior := prior[d.Field]
+				if !inCurrent || !inPrior {
+					continue
+				}
+				if !diff.Equal(current[d.Field], after[d.Field]) {
+					return nil, errRevertChangedSince
+				}
+				col := pq.QuoteIdentifier(d.Field)
+				set = append(set, col+" = r."+col)
+				result.Restored = append(result.Restored, d.Field)
+			}
+			if len(set) == 0 {
+				if inBatch {
+					// Запись пакета, которая ничего не меняла, пропускается
+					result.Noop = true
+					return result, nil
+				}
+				return nil, errRevertNothing
+			}
+			if err := markRevert(); err != nil {
+				return nil, err
+			}
+			res, err = tx.Exec(`
+				UPDATE items
+				SET `+strings.Join(set, ", ")+`
+				FROM item_history h, jsonb_populate_record(NULL::items, h.old_data) r
+				WHERE h.id = $1 AND items.id = h.item_id
+			`, historyID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		err := checkItemVersion(models.Item{ID: result.ItemID, Version: snapshotVersion(prior)}, ifMatch, version)
+		if err != nil {
+			return nil, err
+		}
+		// Восстанавливаем удаленный товар целиком под прежним ID, чтобы он
+		// остался связан со своей историей
+		var cols []string
+		for field := range prior {
+			cols = append(cols, pq.QuoteIdentifier(field))
+			result.Restored = append(result.Restored, field)
+		}
+		sort.Strings(cols)
+		sort.Strings(result.Restored)
+		if err := markRevert(); err != nil {
+			return nil, err
+		}
+		res, err = tx.Exec(`
+			INSERT INTO items (`+strings.Join(cols, ", ")+`)
+			SELECT r.`+strings.Join(cols, ", r.")+`
+			FROM item_history h, jsonb_populate_record(NULL::items, h.old_data) r
+			WHERE h.id = $1
+			ON CONFLICT (id) DO NOTHING
+		`, historyID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		if action == "DELETE" {
+			return nil, errRevertItemExists
+		}
+		return nil, errRevertItemMissing
 	}
 
-	// Логируем откат
-	_, err = database.DB.Exec(`
-		INSERT INTO item_history (item_id, action, changed_by, old_data, new_data, changes)
-		VALUES ($1, 'REVERT', $2, 
-			(SELECT new_data FROM item_history WHERE id = $3),
-			(SELECT old_data FROM item_history WHERE id = $3),
-			jsonb_build_object('reverted_from', $3)
-		)
-	`, itemID, userClaims.Username, historyID)
+	err = tx.QueryRow(`
+		SELECT id FROM item_history
+		WHERE reverted_history_id = $1
+		ORDER BY id DESC LIMIT 1
+	`, historyID).Scan(&result.HistoryID)
 	if err != nil {
-		// Не прерываем операцию, если не удалось залогировать
-		fmt.Printf("Failed to log revert: %v\n", err)
+		return nil, err
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message":   "Change reverted successfully",
-		"item_id":   itemID,
-		"item_name": itemName,
-		"action":    action,
-	})
+	if action == "CREATE" {
+		return result, nil
+	}
+	var item models.Item
+	err = scanItem(tx.QueryRow("SELECT "+itemColumns+" FROM items WHERE id = $1", result.ItemID), &item)
+	if err != nil {
+		return nil, err
+	}
+	result.Item = &item
+	return result, nil
+}
+
+// snapshotVersion - версия товара в снимке истории; у снимков до появления
+// версий ее нет, тогда 0
+func snapshotVersion(snapshot map[string]interface{}) int {
+	n, _ := snapshot["version"].(json.Number)
+	v, _ := n.Int64()
+	return int(v)
 }
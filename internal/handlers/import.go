@@ -0,0 +1,536 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"3.7/internal/auth"
+	"3.7/internal/database"
+	"3.7/internal/middleware"
+	"3.7/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/lib/pq"
+	"github.com/xuri/excelize/v2"
+)
+
+// Ограничения импорта
+const (
+	maxImportSize = 10 << 20
+	maxImportRows = 10000
+)
+
+// importFields - поля товара, которые загружаются из файла
+var importFields = []string{"name", "description", "quantity", "price", "location"}
+
+// importKeyFields - поля, из которых может состоять естественный ключ
+var importKeyFields = map[string]bool{"name": true, "location": true}
+
+// errImportNotApplied откатывает транзакцию проверки: dry-run или ошибки в строках
+var errImportNotApplied = errors.New("import is not applied")
+
+// importRow - строка файла, сопоставленная с товаром
+type importRow struct {
+	result models.ImportRowResult
+	// Значения товара после слияния строки с найденным товаром
+	item models.ImportItem
+	// Найденный по ключу товар и его значения до импорта
+	existingID *int
+	existing   models.ImportItem
+}
+
+// ImportItems загружает товары из CSV или XLSX (поле формы file).
+// Строки сопоставляются с товарами по естественному ключу: найденные
+// обновляются, остальные создаются. Каждая строка проверяется по правилам
+// ImportItem; при ошибке хотя бы в одной строке ничего не пишется.
+// Все записи истории импорта получают общий batch_id.
+func ImportItems(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+	var req models.ImportRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		return
+	}
+
+	key, err := importKey(req.Key)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	mapping := map[string]string{}
+	if req.Mapping != "" {
+		if err := json.Unmarshal([]byte(req.Mapping), &mapping); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mapping: " + err.Error()})
+			return
+		}
+	}
+
+	table, err := readImportTable(file, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(table) < 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File has no data rows"})
+		return
+	}
+	if len(table)-1 > maxImportRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("File has more than %d rows", maxImportRows)})
+		return
+	}
+	columns, err := importColumns(table[0], mapping, key)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+
+	result := models.ImportResult{DryRun: req.DryRun, Rows: []models.ImportRowResult{}}
+	var failedRow *importRow
+	err = database.WithUser(userClaims.Username, func(tx *sql.Tx) error {
+		// Проверка и поиск товаров идут в той же транзакции, что и запись,
+		// поэтому найденные строки не изменятся до применения
+		var rows []*importRow
+		seen := map[string]int{}
+		for i, cells := range table[1:] {
+			if blankRow(cells) {
+				continue
+			}
+			row, err := planImportRow(tx, i+2, cells, columns, key, scope, userClaims)
+			if err != nil {
+				return err
+			}
+			if row.result.Action != "error" {
+				k := importKeyValue(row.item, key)
+				if first, dup := seen[k]; dup {
+					row.fail(fmt.Sprintf("duplicates the key of row %d", first))
+				} else {
+					seen[k] = row.result.Row
+				}
+			}
+			rows = append(rows, row)
+
+			switch row.result.Action {
+			case "create":
+				result.Created++
+			case "update":
+				result.Updated++
+			case "unchanged":
+				result.Unchanged++
+			case "error":
+				result.Failed++
+			}
+		}
+		result.Total = len(rows)
+
+		if req.DryRun || result.Failed > 0 {
+			for _, row := range rows {
+				result.Rows = append(result.Rows, row.result)
+			}
+			return errImportNotApplied
+		}
+
+		if result.Created+result.Updated > 0 {
+			batchID, err := startBatch(tx, "IMPORT", userClaims.Username, file.Filename, nil)
+			if err != nil {
+				return err
+			}
+			if err := finishBatch(tx, batchID, result.Created, result.Updated, 0); err != nil {
+				return err
+			}
+			result.BatchID = &batchID
+		}
+
+		for _, row := range rows {
+			if err := applyImportRow(tx, row, userClaims.Username); err != nil {
+				failedRow = row
+				return err
+			}
+			result.Rows = append(result.Rows, row.result)
+		}
+		result.Applied = true
+		return nil
+	})
+
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, errImportNotApplied):
+		status := http.StatusOK
+		if result.Failed > 0 && !req.DryRun {
+			status = http.StatusUnprocessableEntity
+		}
+		c.JSON(status, result)
+	case failedRow != nil && errors.As(err, &pqErr) && (pqErr.Code.Class() == "22" || pqErr.Code.Class() == "23"):
+		// Значение прошло проверку, но не подошло колонке (например, слишком большая цена)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": fmt.Sprintf("Row %d: %s", failedRow.result.Row, pqErr.Message),
+		})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+func (r *importRow) fail(message string) {
+	r.result.Action = "error"
+	r.result.Errors = append(r.result.Errors, message)
+}
+
+// importKey разбирает поля естественного ключа; по умолчанию name,location
+func importKey(value string) ([]string, error) {
+	if value == "" {
+		return []string{"name", "location"}, nil
+	}
+	var key []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if !importKeyFields[field] {
+			return nil, fmt.Errorf("Invalid key field %q, expected name and/or location", field)
+		}
+		key = append(key, field)
+	}
+	return key, nil
+}
+
+// readImportTable читает таблицу из CSV или XLSX; тип определяется по расширению
+func readImportTable(fh *multipart.FileHeader, req models.ImportRequest) ([][]string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(fh.Filename)) {
+	case ".xlsx":
+		book, err := excelize.OpenReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid XLSX file: %w", err)
+		}
+		defer book.Close()
+
+		sheet := req.Sheet
+		if sheet == "" {
+			sheet = book.GetSheetList()[0]
+		}
+		if index, err := book.GetSheetIndex(sheet); err != nil || index == -1 {
+			return nil, fmt.Errorf("Sheet %q not found", sheet)
+		}
+		// Сырые значения: числа без форматирования ячеек
+		return book.GetRows(sheet, excelize.Options{RawCellValue: true})
+	case ".csv":
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = -1
+		if req.Delimiter != "" {
+			r.Comma = []rune(req.Delimiter)[0]
+		}
+		rows, err := r.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CSV file: %w", err)
+		}
+		if len(rows) > 0 && len(rows[0]) > 0 {
+			rows[0][0] = strings.TrimPrefix(rows[0][0], "\ufeff")
+		}
+		return rows, nil
+	default:
+		return nil, errors.New("Unsupported file type, expected .csv or .xlsx")
+	}
+}
+
+// importColumns сопоставляет поля товара колонкам по заголовкам (без учета регистра).
+// Колонки ключа обязательны, остальные поля без колонки не меняются.
+func importColumns(header []string, mapping map[string]string, key []string) (map[string]int, error) {
+	for field := range mapping {
+		if !isImportField(field) {
+			return nil, fmt.Errorf("Unknown field %q in mapping, expected one of: %s",
+				field, strings.Join(importFields, ", "))
+		}
+	}
+
+	index := map[string]int{}
+	for i, title := range header {
+		title = strings.ToLower(strings.TrimSpace(title))
+		if _, exists := index[title]; !exists {
+			index[title] = i
+		}
+	}
+
+	columns := map[string]int{}
+	for _, field := range importFields {
+		title, mapped := mapping[field]
+		if !mapped {
+			title = field
+		}
+		i, ok := index[strings.ToLower(strings.TrimSpace(title))]
+		if !ok {
+			if mapped {
+				return nil, fmt.Errorf("Column %q mapped to %s not found", title, field)
+			}
+			continue
+		}
+		columns[field] = i
+	}
+	for _, field := range key {
+		if _, ok := columns[field]; !ok {
+			return nil, fmt.Errorf("Key column %s not found", field)
+		}
+	}
+	return columns, nil
+}
+
+func isImportField(field string) bool {
+	for _, f := range importFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func blankRow(cells []string) bool {
+	for _, cell := range cells {
+		if strings.TrimSpace(cell) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// planImportRow разбирает строку, ищет товар по ключу и проверяет итоговые
+// значения. Ошибки данных попадают в результат строки, ошибка БД прерывает импорт.
+func planImportRow(tx *sql.Tx, line int, cells []string, columns map[string]int, key []string,
+	scope *auth.LocationScope, claims *auth.Claims) (*importRow, error) {
+	row := &importRow{result: models.ImportRowResult{Row: line}}
+
+	// Пустая ячейка означает "не менять"; для полей ключа - пустое значение
+	isKey := map[string]bool{}
+	for _, field := range key {
+		isKey[field] = true
+	}
+	value := func(field string) (string, bool) {
+		i, ok := columns[field]
+		if !ok {
+			return "", false
+		}
+		v := ""
+		if i < len(cells) {
+			v = strings.TrimSpace(cells[i])
+		}
+		return v, v != "" || isKey[field]
+	}
+
+	var values models.UpdateItemRequest
+	if v, ok := value("name"); ok {
+		values.Name = &v
+	}
+	if v, ok := value("description"); ok {
+		values.Description = &v
+	}
+	if v, ok := value("location"); ok {
+		values.Location = &v
+	}
+	if v, ok := value("quantity"); ok {
+		quantity, err := strconv.Atoi(v)
+		if f, ferr := strconv.ParseFloat(v, 64); err != nil && ferr == nil && f == float64(int(f)) {
+			// Целые числа из XLSX могут прийти как "10.0"
+			quantity, err = int(f), nil
+		}
+		if err != nil {
+			row.fail(fmt.Sprintf("quantity: %q is not an integer", v))
+		} else {
+			values.Quantity = &quantity
+		}
+	}
+	if v, ok := value("price"); ok {
+		if !strings.Contains(v, ".") {
+			v = strings.Replace(v, ",", ".", 1)
+		}
+		price, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			row.fail(fmt.Sprintf("price: %q is not a number", v))
+		} else {
+			values.Price = &price
+		}
+	}
+	if row.result.Action == "error" {
+		return row, nil
+	}
+
+	// Поиск товара по ключу; строка блокируется до конца транзакции
+	where := ""
+	args := []interface{}{}
+	for _, field := range key {
+		var v string
+		if field == "name" {
+			v = *values.Name
+		} else {
+			v = *values.Location
+		}
+		args = append(args, v)
+		where += fmt.Sprintf(" AND COALESCE(%s, '') = $%d", field, len(args))
+	}
+	matches, err := tx.Query(`
+		SELECT id, name, COALESCE(description, ''), quantity, price, COALESCE(location, '')
+		FROM items
+		WHERE 1=1`+where+`
+		ORDER BY id
+		FOR UPDATE
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	found := 0
+	for matches.Next() {
+		found++
+		var id int
+		err := matches.Scan(&id, &row.existing.Name, &row.existing.Description,
+			&row.existing.Quantity, &row.existing.Price, &row.existing.Location)
+		if err != nil {
+			matches.Close()
+			return nil, err
+		}
+		row.existingID = &id
+	}
+	matches.Close()
+	if err := matches.Err(); err != nil {
+		return nil, err
+	}
+	if found > 1 {
+		row.fail(fmt.Sprintf("key matches %d items", found))
+		return row, nil
+	}
+
+	// Итоговые значения: найденный товар, поверх него - значения строки
+	if row.existingID != nil {
+		row.item = row.existing
+	}
+	if values.Name != nil {
+		row.item.Name = *values.Name
+	}
+	if values.Description != nil {
+		row.item.Description = *values.Description
+	}
+	if values.Quantity != nil {
+		row.item.Quantity = *values.Quantity
+	}
+	if values.Price != nil {
+		row.item.Price = *values.Price
+	}
+	if values.Location != nil {
+		row.item.Location = *values.Location
+	}
+
+	if err := binding.Validator.ValidateStruct(&row.item); err != nil {
+		var fieldErrors validator.ValidationErrors
+		if !errors.As(err, &fieldErrors) {
+			return nil, err
+		}
+		for _, fe := range fieldErrors {
+			row.fail(fmt.Sprintf("%s: failed on the '%s' rule", strings.ToLower(fe.Field()), fe.Tag()))
+		}
+	}
+	if !scope.Allows(row.item.Location) || (row.existingID != nil && !scope.Allows(row.existing.Location)) {
+		row.fail("location is outside of your scope")
+	}
+
+	switch {
+	case row.existingID == nil:
+		if !claims.Can("create") {
+			row.fail("insufficient permissions to create items")
+		}
+		if row.result.Action != "error" {
+			row.result.Action = "create"
+		}
+	case row.item == row.existing:
+		if row.result.Action != "error" {
+			row.result.Action = "unchanged"
+		}
+	default:
+		if !claims.Can("update") {
+			row.fail("insufficient permissions to update items")
+		}
+		if row.result.Action != "error" {
+			row.result.Action = "update"
+		}
+	}
+	row.result.ItemID = row.existingID
+	return row, nil
+}
+
+// importKeyValue - значение естественного ключа строки для поиска дублей в файле
+func importKeyValue(item models.ImportItem, key []string) string {
+	var parts []string
+	for _, field := range key {
+		if field == "name" {
+			parts = append(parts, item.Name)
+		} else {
+			parts = append(parts, item.Location)
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// applyImportRow записывает строку; обновляются только изменившиеся поля
+func applyImportRow(tx *sql.Tx, row *importRow, username string) error {
+	item := row.item
+	switch row.result.Action {
+	case "create":
+		var id int
+		err := tx.QueryRow(`
+			INSERT INTO items (name, description, quantity, price, location, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id
+		`, item.Name, item.Description, item.Quantity, item.Price, item.Location, username).Scan(&id)
+		if err != nil {
+			return err
+		}
+		row.result.ItemID = &id
+	case "update":
+		var set []string
+		var args []interface{}
+		add := func(column string, value interface{}) {
+			args = append(args, value)
+			set = append(set, fmt.Sprintf("%s = $%d", column, len(args)))
+		}
+		if item.Name != row.existing.Name {
+			add("name", item.Name)
+		}
+		if item.Description != row.existing.Description {
+			add("description", item.Description)
+		}
+		if item.Quantity != row.existing.Quantity {
+			add("quantity", item.Quantity)
+		}
+		if item.Price != row.existing.Price {
+			add("price", item.Price)
+		}
+		if item.Location != row.existing.Location {
+			add("location", item.Location)
+		}
+		args = append(args, *row.existingID)
+		_, err := tx.Exec("UPDATE items SET "+strings.Join(set, ", ")+
+			fmt.Sprintf(" WHERE id = $%d", len(args)), args...)
+		return err
+	}
+	return nil
+}
@@ -2,23 +2,94 @@ package handlers
 
 import (
 	"database/sql"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"3.7/internal/auth"
 	"3.7/internal/database"
+	"3.7/internal/diff"
+	"3.7/internal/middleware"
 	"3.7/internal/models"
 
 	"github.com/gin-gonic/gin"
 )
 
-func CreateItem(c *gin.Context) {
-	claims, _ := c.Get("claims")
-	userClaims := claims.(*auth.Claims)
-	if !auth.HasPermission(userClaims.Role, "create") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
-		return
+var (
+	errItemNotFound   = errors.New("item not found")
+	errItemOutOfScope = errors.New("location is outside of your scope")
+	// errItemModified - If-Match не совпал с текущим ETag товара
+	errItemModified = errors.New("item has been modified")
+	// errItemVersionConflict - ожидаемая версия не совпала с текущей
+	errItemVersionConflict = errors.New("item version conflict")
+	errItemVersionRequired = errors.New("version is required")
+)
+
+// itemColumns - колонки товара в порядке полей models.Item (см. scanItem);
+// необязательные колонки приводятся к пустой строке
+const itemColumns = "id, name, COALESCE(description, ''), quantity, price, COALESCE(location, ''), " +
+	"created_at, updated_at, COALESCE(created_by, ''), version"
+
+// scanItem читает строку с колонками itemColumns
+func scanItem(row interface{ Scan(...interface{}) error }, item *models.Item) error {
+	return row.Scan(&item.ID, &item.Name, &item.Description, &item.Quantity,
+		&item.Price, &item.Location, &item.CreatedAt, &item.UpdatedAt, &item.CreatedBy, &item.Version)
+}
+
+// itemETag - ETag товара: версия растет при каждой записи
+func itemETag(item models.Item) string {
+	return fmt.Sprintf(`"%d-%d"`, item.ID, item.Version)
+}
+
+// etagMatches сверяет ETag с заголовком If-Match/If-None-Match (список или "*").
+// weak - слабое сравнение для If-None-Match: префикс W/ не учитывается.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
 	}
+	return false
+}
+
+// respondItemError отвечает на ошибку операции с товаром
+func respondItemError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errItemNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+	case errors.Is(err, errItemOutOfScope):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Location is outside of your scope"})
+	case errors.Is(err, errItemModified):
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Item has been modified, reload it and try again"})
+	case errors.Is(err, errItemVersionRequired):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected version is required (version or If-Match)"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// respondItemWriteError отвечает на ошибку изменения или удаления товара;
+// при конфликте клиент получает текущее состояние товара
+func respondItemWriteError(c *gin.Context, err error, current models.Item) {
+	switch {
+	case errors.Is(err, errItemVersionConflict):
+		c.Header("ETag", itemETag(current))
+		c.JSON(http.StatusConflict, gin.H{"error": "Item has been changed by someone else", "item": current})
+	case errors.Is(err, errItemModified):
+		c.Header("ETag", itemETag(current))
+		respondItemError(c, err)
+	default:
+		respondItemError(c, err)
+	}
+}
+
+func CreateItem(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
 
 	var req models.CreateItemRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -26,63 +97,191 @@ func CreateItem(c *gin.Context) {
 		return
 	}
 
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+
 	var item models.Item
-	err := database.DB.QueryRow(`
-		INSERT INTO items (name, description, quantity, price, location, created_by)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, name, description, quantity, price, location, created_at, updated_at, created_by
-	`, req.Name, req.Description, req.Quantity, req.Price, req.Location, userClaims.Username).
-	Scan(&item.ID, &item.Name, &item.Description, &item.Quantity, &item.Price,
-		&item.Location, &item.CreatedAt, &item.UpdatedAt, &item.CreatedBy)
+	err := database.WithUser(userClaims.Username, func(tx *sql.Tx) error {
+		var err error
+		item, err = insertItem(tx, req, userClaims.Username, scope)
+		return err
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondItemError(c, err)
 		return
 	}
 
+	c.Header("ETag", itemETag(item))
 	c.JSON(http.StatusCreated, item)
 }
 
+// GetItem возвращает один товар с ETag; If-None-Match с текущим ETag - 304
+func GetItem(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+
+	var item models.Item
+	err = scanItem(database.DB.QueryRow("SELECT "+itemColumns+" FROM items WHERE id = $1", id), &item)
+	if err == sql.ErrNoRows {
+		err = errItemNotFound
+	} else if err == nil && !scope.Allows(item.Location) {
+		err = errItemOutOfScope
+	}
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+
+	etag := itemETag(item)
+	c.Header("ETag", etag)
+	// Ответ зависит от пользователя (зона, права): прокси не должны отдавать его другим
+	c.Header("Cache-Control", "private, no-cache")
+	if match := c.GetHeader("If-None-Match"); match != "" && etagMatches(match, etag, true) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+// itemSearchVector - выражение индекса idx_items_search; запрос должен
+// повторять его дословно, иначе индекс не используется
+const itemSearchVector = "to_tsvector('simple', COALESCE(name, '') || ' ' || COALESCE(description, ''))"
+
+// GetItems возвращает страницу товаров с фильтрами, поиском и сортировкой
 func GetItems(c *gin.Context) {
-	claims, _ := c.Get("claims")
-	userClaims := claims.(*auth.Claims)
-	if !auth.HasPermission(userClaims.Role, "read") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+	userClaims := middleware.MustGetClaims(c)
+
+	var filter models.ItemFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.Limit == 0 {
+		filter.Limit = 50
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+	where, args := itemFilterCondition(scope, filter)
+
+	page := models.ItemPage{Items: []models.Item{}, Limit: filter.Limit, Offset: filter.Offset}
+	err := database.DB.QueryRow("SELECT COUNT(*) FROM items WHERE 1=1"+where, args...).Scan(&page.Total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	rows, err := database.DB.Query(`
-		SELECT id, name, description, quantity, price, location, created_at, updated_at, created_by
-		FROM items
-		ORDER BY id
-	`)
+	argCount := len(args) + 1
+	query := "SELECT " + itemColumns + " FROM items WHERE 1=1" + where +
+		fmt.Sprintf(" ORDER BY %s LIMIT $%d OFFSET $%d", itemOrder(filter, len(args)), argCount, argCount+1)
+	rows, err := database.DB.Query(query, append(args, filter.Limit, filter.Offset)...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	defer rows.Close()
 
-	var items []models.Item
 	for rows.Next() {
 		var item models.Item
-		err := rows.Scan(&item.ID, &item.Name, &item.Description, &item.Quantity,
-			&item.Price, &item.Location, &item.CreatedAt, &item.UpdatedAt, &item.CreatedBy)
-		if err != nil {
+		if err := scanItem(rows, &item); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		items = append(items, item)
+		page.Items = append(page.Items, item)
 	}
 
-	c.JSON(http.StatusOK, items)
+	c.JSON(http.StatusOK, page)
 }
 
-func UpdateItem(c *gin.Context) {
-	claims, _ := c.Get("claims")
-	userClaims := claims.(*auth.Claims)
-	if !auth.HasPermission(userClaims.Role, "update") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
-		return
+// itemFilterCondition строит условия WHERE для списка товаров
+func itemFilterCondition(scope *auth.LocationScope, filter models.ItemFilter) (string, []interface{}) {
+	where := ""
+	args := []interface{}{}
+	argCount := 1
+
+	scopeCond, scopeArgs := scope.Condition("location", argCount)
+	where += scopeCond
+	args = append(args, scopeArgs...)
+	argCount += len(scopeArgs)
+
+	if filter.Location != nil {
+		where += fmt.Sprintf(" AND location = $%d", argCount)
+		args = append(args, *filter.Location)
+		argCount++
+	}
+
+	if filter.CreatedBy != nil {
+		where += fmt.Sprintf(" AND created_by = $%d", argCount)
+		args = append(args, *filter.CreatedBy)
+		argCount++
+	}
+
+	if filter.MinQuantity != nil {
+		where += fmt.Sprintf(" AND quantity >= $%d", argCount)
+		args = append(args, *filter.MinQuantity)
+		argCount++
+	}
+
+	if filter.MaxQuantity != nil {
+		where += fmt.Sprintf(" AND quantity <= $%d", argCount)
+		args = append(args, *filter.MaxQuantity)
+		argCount++
+	}
+
+	if filter.MinPrice != nil {
+		where += fmt.Sprintf(" AND price >= $%d", argCount)
+		args = append(args, *filter.MinPrice)
+		argCount++
+	}
+
+	if filter.MaxPrice != nil {
+		where += fmt.Sprintf(" AND price <= $%d", argCount)
+		args = append(args, *filter.MaxPrice)
+		argCount++
+	}
+
+	if filter.Q != "" {
+		where += fmt.Sprintf(" AND %s @@ websearch_to_tsquery('simple', $%d)", itemSearchVector, argCount)
+		args = append(args, filter.Q)
+	}
+
+	return where, args
+}
+
+// itemOrder - ORDER BY списка товаров. Колонка sort проверена binding (oneof),
+// id в конце делает порядок страниц устойчивым. searchArg - номер аргумента
+// поиска: itemFilterCondition добавляет его последним.
+func itemOrder(filter models.ItemFilter, searchArg int) string {
+	order := "ASC"
+	if filter.Order == "desc" {
+		order = "DESC"
+	}
+	if filter.Sort == "" {
+		if filter.Q != "" {
+			return fmt.Sprintf("ts_rank(%s, websearch_to_tsquery('simple', $%d)) DESC, id", itemSearchVector, searchArg)
+		}
+		return "id " + order
 	}
+	return fmt.Sprintf("%s %s NULLS LAST, id %s", filter.Sort, order, order)
+}
+
+func UpdateItem(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
 
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -96,14 +295,121 @@ func UpdateItem(c *gin.Context) {
 		return
 	}
 
-	// Проверяем существование товара
-	var exists bool
-	err = database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM items WHERE id = $1)", id).Scan(&exists)
-	if err != nil || !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
 		return
 	}
 
+	var item models.Item
+	err = database.WithUser(userClaims.Username, func(tx *sql.Tx) error {
+		item, err = updateItem(tx, id, req, scope, c.GetHeader("If-Match"))
+		return err
+	})
+	if err != nil {
+		respondItemWriteError(c, err, item)
+		return
+	}
+
+	c.Header("ETag", itemETag(item))
+	c.JSON(http.StatusOK, item)
+}
+
+func DeleteItem(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var version *int
+	if raw := c.Query("version"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+			return
+		}
+		version = &v
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+
+	// Удаляем товар (триггер запишет в историю)
+	var item models.Item
+	err = database.WithUser(userClaims.Username, func(tx *sql.Tx) error {
+		item, err = deleteItem(tx, id, scope, c.GetHeader("If-Match"), version)
+		return err
+	})
+	if err != nil {
+		respondItemWriteError(c, err, item)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Item deleted successfully"})
+}
+
+// insertItem создает товар в транзакции с автором изменений
+func insertItem(tx *sql.Tx, req models.CreateItemRequest, username string, scope *auth.LocationScope) (models.Item, error) {
+	var item models.Item
+	if !scope.Allows(req.Location) {
+		return item, errItemOutOfScope
+	}
+	err := scanItem(tx.QueryRow(`
+		INSERT INTO items (name, description, quantity, price, location, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+itemColumns,
+		req.Name, req.Description, req.Quantity, req.Price, req.Location, username), &item)
+	return item, err
+}
+
+// lockItem блокирует товар до конца транзакции и проверяет зону и ожидаемую
+// версию: If-Match и/или номер версии, хотя бы одно из них обязательно.
+// При ошибке возвращается текущее состояние товара.
+func lockItem(tx *sql.Tx, id int, scope *auth.LocationScope, ifMatch string, version *int) (models.Item, error) {
+	if ifMatch == "" && version == nil {
+		return models.Item{}, errItemVersionRequired
+	}
+
+	var item models.Item
+	err := scanItem(tx.QueryRow("SELECT "+itemColumns+" FROM items WHERE id = $1 FOR UPDATE", id), &item)
+	if err == sql.ErrNoRows {
+		return item, errItemNotFound
+	}
+	if err != nil {
+		return item, err
+	}
+	if !scope.Allows(item.Location) {
+		return item, errItemOutOfScope
+	}
+	return item, checkItemVersion(item, ifMatch, version)
+}
+
+// checkItemVersion сверяет товар с ожиданием клиента: If-Match и/или версией
+func checkItemVersion(item models.Item, ifMatch string, version *int) error {
+	if ifMatch != "" && !etagMatches(ifMatch, itemETag(item), false) {
+		return errItemModified
+	}
+	if version != nil && *version != item.Version {
+		return errItemVersionConflict
+	}
+	return nil
+}
+
+// updateItem применяет к товару заданные поля запроса. Товар блокируется
+// до конца транзакции, так что проверки и изменение видят одну версию.
+func updateItem(tx *sql.Tx, id int, req models.UpdateItemRequest, scope *auth.LocationScope, ifMatch string) (models.Item, error) {
+	item, err := lockItem(tx, id, scope, ifMatch, req.Version)
+	if err != nil {
+		return item, err
+	}
+	if req.Location != nil && !scope.Allows(*req.Location) {
+		return item, errItemOutOfScope
+	}
+
 	// Собираем динамический запрос
 	query := "UPDATE items SET "
 	args := []interface{}{}
@@ -135,78 +441,32 @@ func UpdateItem(c *gin.Context) {
 		argCount++
 	}
 
-	query = query[:len(query)-2] // Убираем последнюю запятую и пробел
-	query += " WHERE id = $" + strconv.Itoa(argCount)
-	args = append(args, id)
-
-	_, err = database.DB.Exec(query, args...)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	// Без полей изменять нечего: возвращаем товар как есть
+	if len(args) == 0 {
+		return item, nil
 	}
 
-	// Получаем обновленный товар
-	var item models.Item
-	err = database.DB.QueryRow(`
-		SELECT id, name, description, quantity, price, location, created_at, updated_at, created_by
-		FROM items WHERE id = $1
-	`, id).Scan(&item.ID, &item.Name, &item.Description, &item.Quantity,
-		&item.Price, &item.Location, &item.CreatedAt, &item.UpdatedAt, &item.CreatedBy)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+	query = query[:len(query)-2] // Убираем последнюю запятую и пробел
+	query += " WHERE id = $" + strconv.Itoa(argCount) + " RETURNING " + itemColumns
+	args = append(args, id)
 
-	c.JSON(http.StatusOK, item)
+	err = scanItem(tx.QueryRow(query, args...), &item)
+	return item, err
 }
 
-func DeleteItem(c *gin.Context) {
-	claims, _ := c.Get("claims")
-	userClaims := claims.(*auth.Claims)
-	if !auth.HasPermission(userClaims.Role, "delete") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
-		return
-	}
-
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
-		return
-	}
-
-	// Получаем товар перед удалением для истории
-	var item models.Item
-	err = database.DB.QueryRow(`
-		SELECT id, name, description, quantity, price, location, created_at, updated_at, created_by
-		FROM items WHERE id = $1
-	`, id).Scan(&item.ID, &item.Name, &item.Description, &item.Quantity,
-		&item.Price, &item.Location, &item.CreatedAt, &item.UpdatedAt, &item.CreatedBy)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
-		return
-	}
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Удаляем товар (триггер запишет в историю)
-	_, err = database.DB.Exec("DELETE FROM items WHERE id = $1", id)
+// deleteItem удаляет товар и возвращает его последнее состояние
+func deleteItem(tx *sql.Tx, id int, scope *auth.LocationScope, ifMatch string, version *int) (models.Item, error) {
+	item, err := lockItem(tx, id, scope, ifMatch, version)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return item, err
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Item deleted successfully"})
+	_, err = tx.Exec("DELETE FROM items WHERE id = $1", id)
+	return item, err
 }
 
 func GetItemHistory(c *gin.Context) {
-	claims, _ := c.Get("claims")
-	userClaims := claims.(*auth.Claims)
-	if !auth.HasPermission(userClaims.Role, "history") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
-		return
-	}
+	userClaims := middleware.MustGetClaims(c)
 
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -224,67 +484,25 @@ func GetItemHistory(c *gin.Context) {
 		filter.Limit = 50
 	}
 
-	query := `
-		SELECT id, item_id, action, changed_by, changed_at, old_data, new_data, changes
-		FROM item_history
-		WHERE item_id = $1
-	`
-	args := []interface{}{id}
-	argCount := 2
-
-	if filter.ChangedBy != nil {
-		query += " AND changed_by = $" + strconv.Itoa(argCount)
-		args = append(args, *filter.ChangedBy)
-		argCount++
-	}
-	if filter.Action != nil {
-		query += " AND action = $" + strconv.Itoa(argCount)
-		args = append(args, *filter.Action)
-		argCount++
-	}
-	if filter.FromDate != nil {
-		query += " AND changed_at >= $" + strconv.Itoa(argCount)
-		args = append(args, *filter.FromDate)
-		argCount++
-	}
-	if filter.ToDate != nil {
-		query += " AND changed_at <= $" + strconv.Itoa(argCount)
-		args = append(args, *filter.ToDate)
-		argCount++
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
 	}
 
-	query += " ORDER BY changed_at DESC LIMIT $" + strconv.Itoa(argCount) + " OFFSET $" + strconv.Itoa(argCount+1)
-	args = append(args, filter.Limit, filter.Offset)
+	filter.ItemID = &id
+	where, args := historyFilterCondition(scope, filter)
 
-	rows, err := database.DB.Query(query, args...)
+	page, err := queryHistoryPage(where, args, filter.Limit, filter.Offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
-
-	var history []models.ItemHistory
-	for rows.Next() {
-		var h models.ItemHistory
-		err := rows.Scan(&h.ID, &h.ItemID, &h.Action, &h.ChangedBy,
-			&h.ChangedAt, &h.OldData, &h.NewData, &h.Changes)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		history = append(history, h)
-	}
 
-	c.JSON(http.StatusOK, history)
+	c.JSON(http.StatusOK, page)
 }
 
 func GetHistoryDiff(c *gin.Context) {
-	claims, _ := c.Get("claims")
-	userClaims := claims.(*auth.Claims)
-	if !auth.HasPermission(userClaims.Role, "history") {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
-		return
-	}
+	userClaims := middleware.MustGetClaims(c)
 
 	historyID, err := strconv.Atoi(c.Param("history_id"))
 	if err != nil {
@@ -292,12 +510,15 @@ func GetHistoryDiff(c *gin.Context) {
 		return
 	}
 
-	var history models.ItemHistory
+	var (
+		history  models.ItemHistory
+		location string
+	)
 	err = database.DB.QueryRow(`
-		SELECT old_data, new_data, changes
+		SELECT COALESCE(old_data::text, ''), COALESCE(new_data::text, ''), `+historyLocation("")+`
 		FROM item_history
 		WHERE id = $1
-	`, historyID).Scan(&history.OldData, &history.NewData, &history.Changes)
+	`, historyID).Scan(&history.OldData, &history.NewData, &location)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "History record not found"})
 		return
@@ -307,22 +528,20 @@ func GetHistoryDiff(c *gin.Context) {
 		return
 	}
 
-	var changes map[string]interface{}
-	if err := json.Unmarshal([]byte(history.Changes), &changes); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse changes"})
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+	if !scope.Allows(location) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Location is outside of your scope"})
 		return
 	}
 
-	// Преобразуем изменения в удобный формат
-	var diffs []models.DiffResponse
-	for field, data := range changes {
-		if dataMap, ok := data.(map[string]interface{}); ok {
-			diffs = append(diffs, models.DiffResponse{
-				Field: field,
-				Old:   dataMap["old"],
-				New:   dataMap["new"],
-			})
-		}
+	// Сравниваем снимки до и после записи: для CREATE и DELETE один из них пуст
+	diffs, err := diff.Rows(history.OldData, history.NewData, diff.Items)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse changes"})
+		return
 	}
 
 	c.JSON(http.StatusOK, diffs)
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"net/http"
+	"3.7/internal/auth"
+	"3.7/internal/database"
+	"3.7/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// historyLocation - локация товара в записи истории (после изменения,
+// а для DELETE - до него)
+func historyLocation(alias string) string {
+	return "COALESCE(" + alias + "new_data->>'location', " + alias + "old_data->>'location', '')"
+}
+
+// locationScope загружает зону пользователя; при ошибке отвечает 500
+func locationScope(c *gin.Context, username string) (*auth.LocationScope, bool) {
+	scope, err := auth.LoadLocationScope(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return scope, true
+}
+
+// GetUserLocations возвращает зону локаций пользователя
+func GetUserLocations(c *gin.Context) {
+	username := c.Param("username")
+	if !userExists(c, username) {
+		return
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT location, is_prefix FROM user_location_scopes
+		WHERE username = $1
+		ORDER BY location
+	`, username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	rules := []models.LocationRule{}
+	for rows.Next() {
+		var r models.LocationRule
+		if err := rows.Scan(&r.Location, &r.IsPrefix); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		rules = append(rules, r)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"username":     username,
+		"unrestricted": len(rules) == 0,
+		"locations":    rules,
+	})
+}
+
+// SetUserLocations полностью заменяет зону локаций пользователя.
+// Пустой список снимает ограничения.
+func SetUserLocations(c *gin.Context) {
+	username := c.Param("username")
+
+	var rules []models.LocationRule
+	if err := c.ShouldBindJSON(&rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, r := range rules {
+		if r.Location == "" || len(r.Location) > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Location must be 1-100 characters"})
+			return
+		}
+	}
+
+	if !userExists(c, username) {
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM user_location_scopes WHERE username = $1`, username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, r := range rules {
+		_, err := tx.Exec(`
+			INSERT INTO user_location_scopes (username, location, is_prefix)
+			VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING
+		`, username, r.Location, r.IsPrefix)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"username":     username,
+		"unrestricted": len(rules) == 0,
+		"locations":    rules,
+	})
+}
+
+func userExists(c *gin.Context, username string) bool {
+	var exists bool
+	err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", username).Scan(&exists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return false
+	}
+	return true
+}
+
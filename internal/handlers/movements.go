@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"3.7/internal/database"
+	"3.7/internal/middleware"
+	"3.7/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errInsufficientStock = errors.New("insufficient stock")
+
+// movementColumns - колонки движения в порядке полей models.StockMovement (см. scanMovement)
+const movementColumns = `id, item_id, movement_type, quantity_delta, quantity_before, quantity_after,
+	reason_code, COALESCE(reference, ''), COALESCE(note, ''), history_id, COALESCE(created_by, ''), created_at`
+
+// scanMovement читает строку с колонками movementColumns
+func scanMovement(row interface{ Scan(...interface{}) error }, m *models.StockMovement) error {
+	return row.Scan(&m.ID, &m.ItemID, &m.Type, &m.Delta, &m.QuantityBefore, &m.QuantityAfter,
+		&m.ReasonCode, &m.Reference, &m.Note, &m.HistoryID, &m.CreatedBy, &m.CreatedAt)
+}
+
+// CreateStockMovement меняет остаток товара на приращение и записывает
+// движение в журнал. Количество считается в самом UPDATE, поэтому
+// параллельные движения не затирают друг друга, как при PUT с абсолютным
+// количеством.
+func CreateStockMovement(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var req models.StockMovementRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch {
+	case req.Type == "RECEIPT" && req.Delta < 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Receipt delta must be positive"})
+		return
+	case (req.Type == "PICK" || req.Type == "WRITE_OFF") && req.Delta > 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Pick and write-off deltas must be negative"})
+		return
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+
+	var resp models.StockMovementResponse
+	var available int
+	err = database.WithUser(userClaims.Username, func(tx *sql.Tx) error {
+		var location string
+		err := tx.QueryRow(`
+			SELECT COALESCE(location, ''), quantity FROM items WHERE id = $1 FOR UPDATE
+		`, id).Scan(&location, &available)
+		if err == sql.ErrNoRows {
+			return errItemNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !scope.Allows(location) {
+			return errItemOutOfScope
+		}
+
+		err = scanItem(tx.QueryRow(`
+			UPDATE items SET quantity = quantity + $2
+			WHERE id = $1 AND quantity + $2 >= 0
+			RETURNING `+itemColumns, id, req.Delta), &resp.Item)
+		if err == sql.ErrNoRows {
+			return errInsufficientStock
+		}
+		if err != nil {
+			return err
+		}
+
+		// Запись истории от триггера этого UPDATE: товар заблокирован,
+		// так что она последняя по товару
+		var historyID int
+		err = tx.QueryRow(`
+			SELECT id FROM item_history WHERE item_id = $1 ORDER BY id DESC LIMIT 1
+		`, id).Scan(&historyID)
+		if err != nil {
+			return err
+		}
+
+		return scanMovement(tx.QueryRow(`
+			INSERT INTO stock_movements (item_id, movement_type, quantity_delta, quantity_before,
+				quantity_after, reason_code, reference, note, history_id, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9, $10)
+			RETURNING `+movementColumns,
+			id, req.Type, req.Delta, resp.Item.Quantity-req.Delta, resp.Item.Quantity,
+			req.ReasonCode, req.Reference, req.Note, historyID, userClaims.Username), &resp.Movement)
+	})
+	if errors.Is(err, errInsufficientStock) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Insufficient stock", "available": available})
+		return
+	}
+	if err != nil {
+		respondItemError(c, err)
+		return
+	}
+
+	c.Header("ETag", itemETag(resp.Item))
+	c.JSON(http.StatusCreated, resp)
+}
+
+// GetStockMovements возвращает журнал движений товара, новые сначала.
+// Зона проверяется по последней записи истории, чтобы журнал удаленного
+// товара тоже был доступен.
+func GetStockMovements(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	var filter models.StockMovementFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.Limit == 0 {
+		filter.Limit = 50
+	}
+
+	var location string
+	err = database.DB.QueryRow(`
+		SELECT `+historyLocation("")+`
+		FROM item_history
+		WHERE item_id = $1
+		ORDER BY id DESC LIMIT 1
+	`, id).Scan(&location)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	scope, ok := locationScope(c, userClaims.Username)
+	if !ok {
+		return
+	}
+	if !scope.Allows(location) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Location is outside of your scope"})
+		return
+	}
+
+	where := " AND item_id = $1"
+	args := []interface{}{id}
+	if filter.Type != nil {
+		args = append(args, *filter.Type)
+		where += fmt.Sprintf(" AND movement_type = $%d", len(args))
+	}
+
+	page := models.StockMovementPage{Movements: []models.StockMovement{}, Limit: filter.Limit, Offset: filter.Offset}
+	err = database.DB.QueryRow("SELECT COUNT(*) FROM stock_movements WHERE 1=1"+where, args...).Scan(&page.Total)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	argCount := len(args) + 1
+	query := "SELECT " + movementColumns + " FROM stock_movements WHERE 1=1" + where +
+		fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d OFFSET $%d", argCount, argCount+1)
+	rows, err := database.DB.Query(query, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m models.StockMovement
+		if err := scanMovement(rows, &m); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		page.Movements = append(page.Movements, m)
+	}
+
+	c.JSON(http.StatusOK, page)
+}
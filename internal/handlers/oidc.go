@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"3.7/internal/auth"
+	"3.7/internal/database"
+	"3.7/internal/middleware"
+	"3.7/internal/models"
+	"3.7/internal/oidc"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Значение users.auth_provider для учетных записей из IdP
+const oidcProvider = "oidc"
+
+// oidcStateCookie хранит хеш state в браузере, который начал вход: callback
+// принимается только от него (защита от подмены входа, login CSRF)
+const (
+	oidcStateCookie     = "oidc_state"
+	oidcStateCookiePath = "/api/auth/oidc"
+)
+
+// setOIDCStateCookie ставит (maxAge > 0) или удаляет (maxAge < 0) cookie со state
+func setOIDCStateCookie(c *gin.Context, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, value, maxAge, oidcStateCookiePath, "", c.Request.TLS != nil, true)
+}
+
+// OIDCLogin начинает вход через IdP: сохраняет state, nonce и PKCE verifier,
+// привязывает state к браузеру cookie и перенаправляет на страницу авторизации
+func OIDCLogin(c *gin.Context) {
+	provider, err := oidc.Default()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	verifier, err := oidc.RandomString(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	nonce, err := oidc.RandomString(16)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	state, err := auth.CreateOIDCState(auth.OIDCState{CodeVerifier: verifier, Nonce: nonce})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	redirect, err := provider.AuthCodeURL(c.Request.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Println("OIDC login:", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider is unavailable"})
+		return
+	}
+	setOIDCStateCookie(c, auth.HashToken(state), int(auth.OIDCStateTTL.Seconds()))
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// OIDCCallback завершает вход: обменивает код на ID token, определяет роль по
+// группам IdP, создает или обновляет пользователя и выдает наши токены.
+// Токены передаются фронтенду во фрагменте адреса, чтобы не попасть в логи.
+// Если IdP не подтвердил второй фактор (OIDC_MFA_AMR), действует та же
+// политика 2FA, что и при входе по паролю: во фрагменте вместо токенов
+// передается промежуточный вход для /api/auth/2fa/verify.
+func OIDCCallback(c *gin.Context) {
+	provider, err := oidc.Default()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Cookie одноразовая, как и сам state
+	stateCookie, _ := c.Cookie(oidcStateCookie)
+	setOIDCStateCookie(c, "", -1)
+
+	if idpErr := c.Query("error"); idpErr != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Identity provider denied login: " + idpErr})
+		return
+	}
+	code := c.Query("code")
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing authorization code"})
+		return
+	}
+
+	if stateCookie == "" || subtle.ConstantTimeCompare([]byte(stateCookie), []byte(auth.HashToken(c.Query("state")))) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login was started in another browser, try again"})
+		return
+	}
+	state, err := auth.ConsumeOIDCState(c.Query("state"))
+	if errors.Is(err, auth.ErrInvalidOIDCState) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rawIDToken, err := provider.Exchange(c.Request.Context(), code, state.CodeVerifier)
+	if err != nil {
+		log.Println("OIDC callback:", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to exchange authorization code"})
+		return
+	}
+	identity, err := provider.VerifyIDToken(c.Request.Context(), rawIDToken, state.Nonce)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	role, ok := provider.MapRole(identity.Groups)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No warehouse role is assigned to your groups"})
+		return
+	}
+
+	user, err := provisionSSOUser(identity, role)
+	if errors.Is(err, errUsernameTaken) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A local account with this username already exists"})
+		return
+	}
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+	if user.DisabledAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+
+	fragment := url.Values{}
+	if !provider.SecondFactorVerified(identity) {
+		twoFactor, err := auth.TwoFactorEnabled(user.Username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		challenge, err := loginChallenge(*user, twoFactor)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if challenge != nil {
+			fragment.Set("challenge", challenge.Challenge)
+			fragment.Set("setup_required", strconv.FormatBool(challenge.SetupRequired))
+			fragment.Set("expires_in", strconv.Itoa(challenge.ExpiresIn))
+			c.Redirect(http.StatusFound, "/#"+fragment.Encode())
+			return
+		}
+	}
+
+	session, err := auth.CreateSession(user.Username, user.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+	token, err := auth.GenerateToken(session.Username, session.Role, session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	fragment.Set("token", token)
+	fragment.Set("refresh_token", session.RefreshToken)
+	c.Redirect(http.StatusFound, "/#"+fragment.Encode())
+}
+
+var errUsernameTaken = errors.New("username is taken by a local account")
+
+// provisionSSOUser находит пользователя по sub из IdP или создает его (JIT).
+// Роль при каждом входе синхронизируется с группами IdP.
+func provisionSSOUser(identity *oidc.Identity, role models.Role) (*models.User, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		user        models.User
+		roleChanged bool
+	)
+	err = tx.QueryRow(`
+		SELECT username, role, created_at, disabled_at
+		FROM users WHERE auth_provider = $1 AND external_subject = $2
+		FOR UPDATE
+	`, oidcProvider, identity.Subject).Scan(&user.Username, &user.Role, &user.CreatedAt, &user.DisabledAt)
+
+	switch {
+	case err == sql.ErrNoRows:
+		err = tx.QueryRow(`
+			INSERT INTO users (username, password_hash, role, auth_provider, external_subject)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (username) DO NOTHING
+			RETURNING username, role, created_at, disabled_at
+		`, identity.Username, auth.NoPasswordHash, role, oidcProvider, identity.Subject).
+			Scan(&user.Username, &user.Role, &user.CreatedAt, &user.DisabledAt)
+		if err == sql.ErrNoRows {
+			return nil, errUsernameTaken
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := recordUserHistory(tx, "CREATE", user.Username, nil, &user); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case user.Role != role:
+		before := user
+		user.Role = role
+		roleChanged = true
+		if _, err := tx.Exec(`
+			UPDATE users SET role = $1, updated_at = CURRENT_TIMESTAMP WHERE username = $2
+		`, role, user.Username); err != nil {
+			return nil, err
+		}
+		if err := recordUserHistory(tx, "UPDATE", user.Username, &before, &user); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	// Старые сессии выданы со старой ролью
+	if roleChanged {
+		if err := auth.RevokeUserSessions(user.Username); err != nil {
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// GetAccount возвращает текущего пользователя с его правами; нужен фронтенду
+// после входа через SSO, когда в руках только токены
+func GetAccount(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	var user models.User
+	err := database.DB.QueryRow(`
+		SELECT username, role, created_at, disabled_at, locked_until
+		FROM users WHERE username = $1
+	`, userClaims.Username).Scan(&user.Username, &user.Role, &user.CreatedAt, &user.DisabledAt, &user.LockedUntil)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	user.Permissions = auth.RolePermissions(user.Role)
+	c.JSON(http.StatusOK, user)
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"3.7/internal/auth"
+	"3.7/internal/database"
+	"3.7/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// GetPermissions возвращает справочник всех известных прав
+func GetPermissions(c *gin.Context) {
+	rows, err := database.DB.Query(`
+		SELECT name, COALESCE(description, '') FROM permissions ORDER BY name
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	permissions := []models.Permission{}
+	for rows.Next() {
+		var p models.Permission
+		if err := rows.Scan(&p.Name, &p.Description); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		permissions = append(permissions, p)
+	}
+
+	c.JSON(http.StatusOK, permissions)
+}
+
+// GetRoles возвращает все роли вместе с правами
+func GetRoles(c *gin.Context) {
+	rows, err := database.DB.Query(`
+		SELECT r.name, COALESCE(r.description, ''), r.is_system, r.requires_2fa, r.created_at,
+			COALESCE(ARRAY_AGG(rp.permission ORDER BY rp.permission)
+				FILTER (WHERE rp.permission IS NOT NULL), '{}')
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role = r.name
+		GROUP BY r.name
+		ORDER BY r.name
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	roles := []models.RoleDefinition{}
+	for rows.Next() {
+		var r models.RoleDefinition
+		err := rows.Scan(&r.Name, &r.Description, &r.IsSystem, &r.Requires2FA, &r.CreatedAt,
+			(*pq.StringArray)(&r.Permissions))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		roles = append(roles, r)
+	}
+
+	c.JSON(http.StatusOK, roles)
+}
+
+// CreateRole создает пользовательскую роль с набором прав
+func CreateRole(c *gin.Context) {
+	var req models.CreateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	role := models.RoleDefinition{Name: req.Name, Description: req.Description, Requires2FA: req.Requires2FA}
+	err = tx.QueryRow(`
+		INSERT INTO roles (name, description, requires_2fa)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO NOTHING
+		RETURNING created_at
+	`, req.Name, req.Description, req.Requires2FA).Scan(&role.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "Role already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := setRolePermissions(tx, req.Name, req.Permissions); err != nil {
+		respondPermissionError(c, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auth.InvalidatePermissions()
+
+	role.Permissions = auth.RolePermissions(req.Name)
+	c.JSON(http.StatusCreated, role)
+}
+
+// UpdateRole меняет описание и/или полный список прав роли
+func UpdateRole(c *gin.Context) {
+	name := models.Role(c.Param("name"))
+
+	var req models.UpdateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Права администратора не редактируются, чтобы нельзя было
+	// потерять доступ к управлению ролями
+	if name == models.RoleAdmin && req.Permissions != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Permissions of the admin role cannot be changed"})
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var role models.RoleDefinition
+	err = tx.QueryRow(`
+		UPDATE roles
+		SET description = COALESCE($2, description), requires_2fa = COALESCE($3, requires_2fa)
+		WHERE name = $1
+		RETURNING name, COALESCE(description, ''), is_system, requires_2fa, created_at
+	`, name, req.Description, req.Requires2FA).Scan(&role.Name, &role.Description, &role.IsSystem,
+		&role.Requires2FA, &role.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Permissions != nil {
+		if _, err := tx.Exec(`DELETE FROM role_permissions WHERE role = $1`, name); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := setRolePermissions(tx, name, *req.Permissions); err != nil {
+			respondPermissionError(c, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auth.InvalidatePermissions()
+
+	role.Permissions = auth.RolePermissions(name)
+	c.JSON(http.StatusOK, role)
+}
+
+// DeleteRole удаляет пользовательскую роль, если она никому не назначена
+func DeleteRole(c *gin.Context) {
+	name := c.Param("name")
+
+	var isSystem bool
+	err := database.DB.QueryRow(`SELECT is_system FROM roles WHERE name = $1`, name).Scan(&isSystem)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if isSystem {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "System roles cannot be deleted"})
+		return
+	}
+
+	_, err = database.DB.Exec(`DELETE FROM roles WHERE name = $1`, name)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Role is still assigned to users"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auth.InvalidatePermissions()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role deleted successfully"})
+}
+
+func setRolePermissions(tx *sql.Tx, role models.Role, permissions []string) error {
+	_, err := tx.Exec(`
+		INSERT INTO role_permissions (role, permission)
+		SELECT $1, UNNEST($2::text[])
+		ON CONFLICT DO NOTHING
+	`, role, pq.Array(permissions))
+	return err
+}
+
+func respondPermissionError(c *gin.Context, err error) {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown permission"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"3.7/internal/auth"
+	"3.7/internal/database"
+	"3.7/internal/middleware"
+	"3.7/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TwoFactorSetup выдает секрет TOTP при входе пользователя, которому
+// 2FA обязательна, но еще не настроена
+func TwoFactorSetup(c *gin.Context) {
+	var req models.TwoFactorChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	challenge, err := auth.UseLoginChallenge(req.Challenge)
+	if errors.Is(err, auth.ErrInvalidChallenge) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if challenge.Purpose != auth.ChallengeEnroll {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is already set up"})
+		return
+	}
+
+	startEnrollment(c, challenge.Username)
+}
+
+// TwoFactorVerify завершает вход: проверяет TOTP-код (или код восстановления)
+// и выдает токены. При первичной настройке код подтверждает новый секрет.
+func TwoFactorVerify(c *gin.Context) {
+	var req models.TwoFactorVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	challenge, err := auth.UseLoginChallenge(req.Challenge)
+	if errors.Is(err, auth.ErrInvalidChallenge) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var recoveryCodes []string
+	if challenge.Purpose == auth.ChallengeEnroll {
+		recoveryCodes, err = auth.ConfirmTOTPEnrollment(challenge.Username, req.Code)
+	} else {
+		err = auth.VerifySecondFactor(challenge.Username, req.Code, req.RecoveryCode)
+	}
+	if errors.Is(err, auth.ErrInvalidTOTPCode) {
+		respondInvalidCode(c, challenge.Username)
+		return
+	}
+	if errors.Is(err, auth.ErrNoPendingEnrollment) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := auth.DeleteLoginChallenge(req.Challenge); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Учетную запись могли отключить, пока вводился код
+	var user models.User
+	err = database.DB.QueryRow(`
+		SELECT username, role, created_at, disabled_at FROM users WHERE username = $1
+	`, challenge.Username).Scan(&user.Username, &user.Role, &user.CreatedAt, &user.DisabledAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": auth.ErrInvalidChallenge.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user.DisabledAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+
+	issueTokens(c, http.StatusOK, user, recoveryCodes)
+}
+
+// SetupTwoFactor начинает подключение TOTP для текущего пользователя
+func SetupTwoFactor(c *gin.Context) {
+	userClaims, ok := interactiveClaims(c)
+	if !ok {
+		return
+	}
+	startEnrollment(c, userClaims.Username)
+}
+
+// EnableTwoFactor подтверждает секрет кодом и возвращает коды восстановления
+func EnableTwoFactor(c *gin.Context) {
+	userClaims, ok := interactiveClaims(c)
+	if !ok {
+		return
+	}
+
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := auth.ConfirmTOTPEnrollment(userClaims.Username, req.Code)
+	if errors.Is(err, auth.ErrInvalidTOTPCode) {
+		respondInvalidCode(c, userClaims.Username)
+		return
+	}
+	if errors.Is(err, auth.ErrNoPendingEnrollment) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+// DisableTwoFactor отключает TOTP, если политика роли это допускает
+func DisableTwoFactor(c *gin.Context) {
+	userClaims, ok := interactiveClaims(c)
+	if !ok {
+		return
+	}
+
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if auth.RequiresTwoFactor(userClaims.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is mandatory for your role"})
+		return
+	}
+
+	err := auth.VerifySecondFactor(userClaims.Username, req.Code, req.RecoveryCode)
+	if errors.Is(err, auth.ErrInvalidTOTPCode) {
+		respondInvalidCode(c, userClaims.Username)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := auth.DisableTOTP(userClaims.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes выдает новый набор кодов восстановления взамен старого
+func RegenerateRecoveryCodes(c *gin.Context) {
+	userClaims, ok := interactiveClaims(c)
+	if !ok {
+		return
+	}
+
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := auth.VerifySecondFactor(userClaims.Username, req.Code, req.RecoveryCode)
+	if errors.Is(err, auth.ErrInvalidTOTPCode) {
+		respondInvalidCode(c, userClaims.Username)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := auth.RegenerateRecoveryCodes(userClaims.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// interactiveClaims - настройки учетной записи недоступны по API-ключу
+func interactiveClaims(c *gin.Context) (*auth.Claims, bool) {
+	userClaims := middleware.MustGetClaims(c)
+	if userClaims.APIKeyID != 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not available for API keys"})
+		return nil, false
+	}
+	return userClaims, true
+}
+
+func startEnrollment(c *gin.Context, username string) {
+	secret, uri, err := auth.StartTOTPEnrollment(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, models.TwoFactorSetupResponse{Secret: secret, OTPAuthURI: uri})
+}
+
+// respondInvalidCode засчитывает неверный код как неудачный вход,
+// чтобы подбор второго фактора ограничивался так же, как подбор пароля
+func respondInvalidCode(c *gin.Context, username string) {
+	wait, err := auth.RecordLoginFailure(username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if wait > 0 {
+		respondTooManyAttempts(c, wait)
+		return
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": auth.ErrInvalidTOTPCode.Error()})
+}
@@ -0,0 +1,401 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+	"3.7/internal/auth"
+	"3.7/internal/database"
+	"3.7/internal/middleware"
+	"3.7/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// GetUsers возвращает список учетных записей
+func GetUsers(c *gin.Context) {
+	rows, err := database.DB.Query(`
+		SELECT username, role, created_at, disabled_at,
+			CASE WHEN locked_until > NOW() THEN locked_until END
+		FROM users
+		ORDER BY username
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		var u models.User
+		if err := rows.Scan(&u.Username, &u.Role, &u.CreatedAt, &u.DisabledAt, &u.LockedUntil); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		users = append(users, u)
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// CreateUser создает учетную запись с указанной ролью
+func CreateUser(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+
+	var req models.CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var user models.User
+	err = tx.QueryRow(`
+		INSERT INTO users (username, password_hash, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (username) DO NOTHING
+		RETURNING username, role, created_at, disabled_at
+	`, req.Username, hash, req.Role).Scan(&user.Username, &user.Role, &user.CreatedAt, &user.DisabledAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username already taken"})
+		return
+	}
+	if err != nil {
+		respondUserError(c, err)
+		return
+	}
+
+	if err := recordUserHistory(tx, "CREATE", userClaims.Username, nil, &user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, user)
+}
+
+// UpdateUser меняет роль, сбрасывает пароль и включает/отключает учетную запись.
+// Любое из этих изменений завершает активные сессии пользователя.
+func UpdateUser(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+	username := c.Param("username")
+
+	var req models.UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Администратор не может сам себя понизить или отключить
+	if username == userClaims.Username &&
+		((req.Role != nil && *req.Role != userClaims.Role) || (req.Disabled != nil && *req.Disabled)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot change your own role or disable yourself"})
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := loadUserForUpdate(tx, username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	changed := false
+
+	if req.Role != nil && *req.Role != user.Role {
+		before := *user
+		if _, err := tx.Exec(`UPDATE users SET role = $2, updated_at = NOW() WHERE username = $1`,
+			username, *req.Role); err != nil {
+			respondUserError(c, err)
+			return
+		}
+		user.Role = *req.Role
+		if err := recordUserHistory(tx, "UPDATE", userClaims.Username, &before, user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		changed = true
+	}
+
+	if req.Password != nil {
+		hash, err := auth.HashPassword(*req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
+		if _, err := tx.Exec(`UPDATE users SET password_hash = $2, updated_at = NOW() WHERE username = $1`,
+			username, hash); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := recordUserHistory(tx, "PASSWORD_RESET", userClaims.Username, user, user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		changed = true
+	}
+
+	if req.Disabled != nil && *req.Disabled != (user.DisabledAt != nil) {
+		before := *user
+		action := "ENABLE"
+		if *req.Disabled {
+			action = "DISABLE"
+		}
+		err := tx.QueryRow(`
+			UPDATE users
+			SET disabled_at = CASE WHEN $2 THEN NOW() ELSE NULL END, updated_at = NOW()
+			WHERE username = $1
+			RETURNING disabled_at
+		`, username, *req.Disabled).Scan(&user.DisabledAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := recordUserHistory(tx, action, userClaims.Username, &before, user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		changed = true
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if changed {
+		if err := auth.RevokeUserSessions(username); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// DeleteUser отключает учетную запись; записи истории ссылаются на
+// пользователя, поэтому физически он не удаляется
+func DeleteUser(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+	username := c.Param("username")
+
+	if username == userClaims.Username {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot disable yourself"})
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := loadUserForUpdate(tx, username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if user.DisabledAt == nil {
+		before := *user
+		err := tx.QueryRow(`
+			UPDATE users SET disabled_at = NOW(), updated_at = NOW()
+			WHERE username = $1
+			RETURNING disabled_at
+		`, username).Scan(&user.DisabledAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := recordUserHistory(tx, "DISABLE", userClaims.Username, &before, user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := auth.RevokeUserSessions(username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User disabled successfully"})
+}
+
+// UnlockUser снимает блокировку после неудачных попыток входа
+func UnlockUser(c *gin.Context) {
+	userClaims := middleware.MustGetClaims(c)
+	username := c.Param("username")
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := loadUserForUpdate(tx, username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := auth.UnlockUser(tx, username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := recordUserHistory(tx, "UNLOCK", userClaims.Username, user, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked successfully"})
+}
+
+// GetUserHistory возвращает журнал изменений учетной записи
+func GetUserHistory(c *gin.Context) {
+	rows, err := database.DB.Query(`
+		SELECT id, username, action, changed_by, changed_at, old_data, new_data, changes
+		FROM user_history
+		WHERE username = $1
+		ORDER BY changed_at DESC, id DESC
+	`, c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	history := []models.UserHistory{}
+	for rows.Next() {
+		var h models.UserHistory
+		err := rows.Scan(&h.ID, &h.Username, &h.Action, &h.ChangedBy,
+			&h.ChangedAt, &h.OldData, &h.NewData, &h.Changes)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		history = append(history, h)
+	}
+
+	c.JSON(http.StatusOK, history)
+}
+
+func loadUserForUpdate(tx *sql.Tx, username string) (*models.User, error) {
+	var user models.User
+	err := tx.QueryRow(`
+		SELECT username, role, created_at, disabled_at
+		FROM users WHERE username = $1
+		FOR UPDATE
+	`, username).Scan(&user.Username, &user.Role, &user.CreatedAt, &user.DisabledAt)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// userSnapshot - состояние пользователя для журнала, без хеша пароля
+func userSnapshot(u *models.User) map[string]interface{} {
+	if u == nil {
+		return nil
+	}
+	var disabledAt interface{}
+	if u.DisabledAt != nil {
+		disabledAt = u.DisabledAt.Format(time.RFC3339)
+	}
+	return map[string]interface{}{
+		"username":    u.Username,
+		"role":        u.Role,
+		"disabled_at": disabledAt,
+	}
+}
+
+// recordUserHistory пишет запись в user_history в той же транзакции
+func recordUserHistory(tx *sql.Tx, action, changedBy string, before, after *models.User) error {
+	oldData, newData := userSnapshot(before), userSnapshot(after)
+
+	changes := map[string]interface{}{}
+	switch {
+	case action == "PASSWORD_RESET":
+		changes["password"] = map[string]interface{}{"old": "***", "new": "***"}
+	case oldData == nil:
+		for field, value := range newData {
+			changes[field] = value
+		}
+	default:
+		for field, value := range newData {
+			if oldValue := oldData[field]; oldValue != value {
+				changes[field] = map[string]interface{}{"old": oldValue, "new": value}
+			}
+		}
+	}
+
+	values := make([]interface{}, 3)
+	for i, v := range []map[string]interface{}{oldData, newData, changes} {
+		if v == nil {
+			continue
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		values[i] = string(data)
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO user_history (username, action, changed_by, old_data, new_data, changes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, after.Username, action, changedBy, values[0], values[1], values[2])
+	return err
+}
+
+func respondUserError(c *gin.Context, err error) {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
@@ -1,26 +1,50 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"strings"
-	"warehouse-system/internal/auth"
+	"3.7/internal/auth"
 
 	"github.com/gin-gonic/gin"
 )
 
+// AuthMiddleware принимает JWT (Authorization: Bearer <token>) или API-ключ
+// (X-API-Key: <key> либо Authorization: Bearer <key>)
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
-			return
+		tokenString := c.GetHeader("X-API-Key")
+		if tokenString == "" {
+			authHeader := c.GetHeader("Authorization")
+			if authHeader == "" {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+				c.Abort()
+				return
+			}
+
+			tokenString = strings.TrimPrefix(authHeader, "Bearer ")
+			if tokenString == authHeader {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Bearer token required"})
+				c.Abort()
+				return
+			}
 		}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		if tokenString == authHeader {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Bearer token required"})
-			c.Abort()
+		if auth.IsAPIKey(tokenString) {
+			claims, err := auth.ValidateAPIKey(tokenString)
+			if errors.Is(err, auth.ErrInvalidAPIKey) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+				c.Abort()
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify API key"})
+				c.Abort()
+				return
+			}
+
+			c.Set(ClaimsKey, claims)
+			c.Next()
 			return
 		}
 
@@ -31,7 +55,21 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		c.Set("claims", claims)
+		// Отозванная сессия (logout, повторное использование refresh-токена)
+		// делает недействительными и выданные в ней access-токены
+		active, err := auth.IsSessionActive(claims.SessionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify session"})
+			c.Abort()
+			return
+		}
+		if !active {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+			c.Abort()
+			return
+		}
+
+		c.Set(ClaimsKey, claims)
 		c.Next()
 	}
 }
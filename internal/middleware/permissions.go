@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"3.7/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClaimsKey - ключ, под которым AuthMiddleware кладет claims в контекст
+const ClaimsKey = "claims"
+
+// AnyUser - вместо права: маршрут доступен любому аутентифицированному пользователю
+const AnyUser = "*"
+
+// GetClaims возвращает claims текущего пользователя, если он аутентифицирован
+func GetClaims(c *gin.Context) (*auth.Claims, bool) {
+	value, exists := c.Get(ClaimsKey)
+	if !exists {
+		return nil, false
+	}
+	claims, ok := value.(*auth.Claims)
+	return claims, ok && claims != nil
+}
+
+// MustGetClaims - то же для обработчиков за AuthMiddleware; без claims паникует,
+// что означает ошибку в регистрации маршрута
+func MustGetClaims(c *gin.Context) *auth.Claims {
+	claims, ok := GetClaims(c)
+	if !ok {
+		panic("middleware: claims are missing, route is not behind AuthMiddleware")
+	}
+	return claims
+}
+
+// RequirePermission пропускает запрос, только если у роли пользователя есть право
+func RequirePermission(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := GetClaims(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			c.Abort()
+			return
+		}
+		if action != AnyUser && !claims.Can(action) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// declaredPermissions - "METHOD /full/path" -> право, объявленное при регистрации
+var declaredPermissions = map[string]string{}
+
+// ProtectedGroup регистрирует маршруты, каждый из которых обязан объявить право
+type ProtectedGroup struct {
+	group *gin.RouterGroup
+}
+
+// Protected оборачивает группу маршрутов (обычно уже с AuthMiddleware)
+func Protected(group *gin.RouterGroup) *ProtectedGroup {
+	return &ProtectedGroup{group: group}
+}
+
+// Handle регистрирует маршрут с проверкой права action
+func (p *ProtectedGroup) Handle(method, path, action string, handlers ...gin.HandlerFunc) {
+	if action == "" {
+		panic(fmt.Sprintf("middleware: route %s %s declares no permission", method, path))
+	}
+	fullPath := strings.TrimSuffix(p.group.BasePath(), "/") + "/" + strings.TrimPrefix(path, "/")
+	declaredPermissions[method+" "+fullPath] = action
+	p.group.Handle(method, path, append([]gin.HandlerFunc{RequirePermission(action)}, handlers...)...)
+}
+
+func (p *ProtectedGroup) GET(path, action string, handlers ...gin.HandlerFunc) {
+	p.Handle(http.MethodGet, path, action, handlers...)
+}
+
+func (p *ProtectedGroup) POST(path, action string, handlers ...gin.HandlerFunc) {
+	p.Handle(http.MethodPost, path, action, handlers...)
+}
+
+func (p *ProtectedGroup) PUT(path, action string, handlers ...gin.HandlerFunc) {
+	p.Handle(http.MethodPut, path, action, handlers...)
+}
+
+func (p *ProtectedGroup) DELETE(path, action string, handlers ...gin.HandlerFunc) {
+	p.Handle(http.MethodDelete, path, action, handlers...)
+}
+
+// VerifyRoutePermissions проверяет, что каждый маршрут с префиксом prefix
+// объявил право; маршруты с префиксами из public намеренно открыты
+func VerifyRoutePermissions(routes gin.RoutesInfo, prefix string, public ...string) error {
+	var missing []string
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, prefix) || isPublicRoute(route.Path, public) {
+			continue
+		}
+		if _, ok := declaredPermissions[route.Method+" "+route.Path]; !ok {
+			missing = append(missing, route.Method+" "+route.Path)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("routes without a required permission: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func isPublicRoute(path string, public []string) bool {
+	for _, p := range public {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
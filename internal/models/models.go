@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -23,27 +24,137 @@ type Item struct {
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
 	CreatedBy   string    `json:"created_by" db:"created_by"`
+	// Растет при каждой записи, см. UpdateItemRequest.Version
+	Version int `json:"version" db:"version"`
 }
 
 type ItemHistory struct {
 	ID         int       `json:"id" db:"id"`
 	ItemID     int       `json:"item_id" db:"item_id"`
-	Action     string    `json:"action" db:"action"` // CREATE, UPDATE, DELETE
+	Action     string    `json:"action" db:"action"` // CREATE, UPDATE, DELETE, REVERT
 	ChangedBy  string    `json:"changed_by" db:"changed_by"`
 	ChangedAt  time.Time `json:"changed_at" db:"changed_at"`
 	OldData    string    `json:"old_data" db:"old_data"`     // JSON предыдущего состояния
 	NewData    string    `json:"new_data" db:"new_data"`     // JSON нового состояния
-	Changes    string    `json:"changes" db:"changes"`       // JSON измененных полей
+	// JSON измененных полей; считается пакетом diff по снимкам
+	Changes string `json:"changes"`
+	// Для REVERT - запись, которую отменили
+	RevertedHistoryID *int `json:"reverted_history_id,omitempty" db:"reverted_history_id"`
+	// Пакет изменений (импорт), в составе которого сделана запись
+	BatchID *string `json:"batch_id,omitempty" db:"batch_id"`
+	// Версия товара после записи; пуста у записей до появления версий
+	Version *int `json:"version" db:"version"`
 }
 
 type User struct {
-	Username string `json:"username" db:"username"`
-	Role     Role   `json:"role" db:"role"`
+	Username     string    `json:"username" db:"username"`
+	PasswordHash string    `json:"-" db:"password_hash"`
+	Role         Role      `json:"role" db:"role"`
+	Permissions  []string   `json:"permissions,omitempty"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	DisabledAt   *time.Time `json:"disabled_at,omitempty" db:"disabled_at"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty" db:"locked_until"`
+}
+
+type UserHistory struct {
+	ID        int       `json:"id" db:"id"`
+	Username  string    `json:"username" db:"username"`
+	Action    string    `json:"action" db:"action"` // CREATE, UPDATE, PASSWORD_RESET, DISABLE, ENABLE, UNLOCK
+	ChangedBy string    `json:"changed_by" db:"changed_by"`
+	ChangedAt time.Time `json:"changed_at" db:"changed_at"`
+	OldData   *string   `json:"old_data" db:"old_data"`
+	NewData   *string   `json:"new_data" db:"new_data"`
+	Changes   *string   `json:"changes" db:"changes"`
+}
+
+type CreateUserRequest struct {
+	Username string `json:"username" binding:"required,min=3,max=50"`
+	Password string `json:"password" binding:"required,min=8,max=72"`
+	Role     Role   `json:"role" binding:"required"`
+}
+
+type UpdateUserRequest struct {
+	Role     *Role   `json:"role"`
+	Password *string `json:"password" binding:"omitempty,min=8,max=72"`
+	Disabled *bool   `json:"disabled"`
+}
+
+// RoleDefinition - роль из таблицы roles вместе с ее правами
+type RoleDefinition struct {
+	Name        Role      `json:"name" db:"name"`
+	Description string    `json:"description" db:"description"`
+	IsSystem    bool      `json:"is_system" db:"is_system"`
+	Requires2FA bool      `json:"requires_2fa" db:"requires_2fa"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+type Permission struct {
+	Name        string `json:"name" db:"name"`
+	Description string `json:"description" db:"description"`
+}
+
+type CreateRoleRequest struct {
+	Name        Role     `json:"name" binding:"required,min=2,max=50"`
+	Description string   `json:"description"`
+	Requires2FA bool     `json:"requires_2fa"`
+	Permissions []string `json:"permissions"`
+}
+
+type UpdateRoleRequest struct {
+	Description *string   `json:"description"`
+	Requires2FA *bool     `json:"requires_2fa"`
+	Permissions *[]string `json:"permissions"`
 }
 
 type LoginRequest struct {
 	Username string `json:"username" binding:"required"`
-	Role     Role   `json:"role" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type RegisterRequest struct {
+	Username string `json:"username" binding:"required,min=3,max=50"`
+	Password string `json:"password" binding:"required,min=8,max=72"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type AuthResponse struct {
+	Token         string   `json:"token"`
+	RefreshToken  string   `json:"refresh_token"`
+	ExpiresIn     int      `json:"expires_in"`
+	User          User     `json:"user"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// TwoFactorChallengeResponse - пароль верен, но для входа нужен второй фактор
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	SetupRequired     bool   `json:"setup_required"`
+	Challenge         string `json:"challenge"`
+	ExpiresIn         int    `json:"expires_in"`
+}
+
+type TwoFactorChallengeRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+}
+
+type TwoFactorVerifyRequest struct {
+	Challenge    string `json:"challenge" binding:"required"`
+	Code         string `json:"code" binding:"required_without=RecoveryCode"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code         string `json:"code" binding:"required_without=RecoveryCode"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type TwoFactorSetupResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
 }
 
 type CreateItemRequest struct {
@@ -60,6 +171,64 @@ type UpdateItemRequest struct {
 	Quantity    *int     `json:"quantity"`
 	Price       *float64 `json:"price"`
 	Location    *string  `json:"location"`
+	// Ожидаемая версия товара; обязательна, если нет заголовка If-Match
+	Version *int `json:"version"`
+}
+
+// ItemFilter - параметры списка товаров. Q - полнотекстовый поиск по
+// названию и описанию; без sort результаты поиска упорядочены по релевантности
+type ItemFilter struct {
+	Location    *string  `form:"location"`
+	CreatedBy   *string  `form:"created_by"`
+	MinQuantity *int     `form:"min_quantity" binding:"omitempty,min=0"`
+	MaxQuantity *int     `form:"max_quantity" binding:"omitempty,min=0"`
+	MinPrice    *float64 `form:"min_price" binding:"omitempty,min=0"`
+	MaxPrice    *float64 `form:"max_price" binding:"omitempty,min=0"`
+	Q           string   `form:"q"`
+	Sort        string   `form:"sort" binding:"omitempty,oneof=id name description quantity price location created_at updated_at created_by version"`
+	Order       string   `form:"order" binding:"omitempty,oneof=asc desc"`
+	Limit       int      `form:"limit" binding:"omitempty,min=1,max=500"`
+	Offset      int      `form:"offset" binding:"min=0"`
+}
+
+// ItemPage - страница товаров; total - число товаров по фильтру без учета limit/offset
+type ItemPage struct {
+	Items  []Item `json:"items"`
+	Total  int    `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+type APIKey struct {
+	ID          int        `json:"id" db:"id"`
+	Name        string     `json:"name" db:"name"`
+	Prefix      string     `json:"prefix" db:"key_prefix"`
+	Username    string     `json:"username" db:"username"`
+	Permissions []string   `json:"permissions" db:"permissions"`
+	CreatedBy   string     `json:"created_by" db:"created_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at" db:"expires_at"`
+	LastUsedAt  *time.Time `json:"last_used_at" db:"last_used_at"`
+	RevokedAt   *time.Time `json:"revoked_at" db:"revoked_at"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name        string     `json:"name" binding:"required,max=100"`
+	Username    string     `json:"username"`
+	Permissions []string   `json:"permissions" binding:"required,min=1"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+// CreateAPIKeyResponse содержит ключ в открытом виде; он показывается один раз
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// LocationRule - одна локация (или префикс локаций) из зоны пользователя
+type LocationRule struct {
+	Location string `json:"location" db:"location" binding:"required,max=100"`
+	IsPrefix bool   `json:"is_prefix" db:"is_prefix"`
 }
 
 type HistoryFilter struct {
@@ -68,12 +237,233 @@ type HistoryFilter struct {
 	Action   *string    `form:"action"`
 	FromDate *time.Time `form:"from_date"`
 	ToDate   *time.Time `form:"to_date"`
-	Limit    int        `form:"limit" binding:"min=1,max=100"`
+	BatchID  *string    `form:"batch_id" binding:"omitempty,uuid"`
+	Limit    int        `form:"limit" binding:"omitempty,min=1,max=100"`
 	Offset   int        `form:"offset" binding:"min=0"`
 }
 
+// HistoryEntry - запись истории с названием товара (для удаленных товаров -
+// название на момент удаления)
+type HistoryEntry struct {
+	ItemHistory
+	ItemName string `json:"item_name"`
+}
+
+// HistoryPage - страница истории; total - число записей по фильтру без учета limit/offset
+type HistoryPage struct {
+	History []HistoryEntry `json:"history"`
+	Total   int            `json:"total"`
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+}
+
+// ItemSnapshot - состояние товара на момент AsOf, восстановленное по истории
+type ItemSnapshot struct {
+	ItemID int       `json:"item_id"`
+	AsOf   time.Time `json:"as_of"`
+	// Exists=false: товар еще не создан или уже удален
+	Exists bool  `json:"exists"`
+	Item   *Item `json:"item"`
+	// Последняя запись истории не позже AsOf и ее действие
+	HistoryID *int   `json:"history_id"`
+	Action    string `json:"action,omitempty"`
+}
+
+// InventorySnapshot - состав склада на момент AsOf
+type InventorySnapshot struct {
+	AsOf          time.Time `json:"as_of"`
+	Items         []Item    `json:"items"`
+	TotalItems    int       `json:"total_items"`
+	TotalQuantity int       `json:"total_quantity"`
+	TotalValue    float64   `json:"total_value"`
+}
+
 type DiffResponse struct {
 	Field   string      `json:"field"`
 	Old     interface{} `json:"old"`
 	New     interface{} `json:"new"`
+	// Для числовых полей - new - old
+	Delta *json.Number `json:"delta,omitempty"`
+	// Для текстовых полей - пословные изменения
+	Words []WordDiff `json:"words,omitempty"`
+}
+
+// WordDiff - фрагмент пословного сравнения: equal, insert или delete
+type WordDiff struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// ItemVersion - версия товара после записи истории; версия без записи -
+// состояние до создания товара
+type ItemVersion struct {
+	HistoryID *int       `json:"history_id"`
+	Version   *int       `json:"version"`
+	Action    string     `json:"action,omitempty"`
+	ChangedAt *time.Time `json:"changed_at,omitempty"`
+	Exists    bool       `json:"exists"`
+}
+
+// ItemDiffResponse - сравнение двух версий товара
+type ItemDiffResponse struct {
+	ItemID  int            `json:"item_id"`
+	From    ItemVersion    `json:"from"`
+	To      ItemVersion    `json:"to"`
+	Changes []DiffResponse `json:"changes"`
+}
+
+// ImportRequest - параметры импорта товаров (поля multipart-формы рядом с file)
+type ImportRequest struct {
+	// Только проверить файл, ничего не записывая
+	DryRun bool `form:"dry_run"`
+	// Естественный ключ для upsert через запятую: name, location
+	Key string `form:"key"`
+	// JSON {"поле": "заголовок колонки"}; без сопоставления колонка
+	// ищется по имени поля
+	Mapping string `form:"mapping"`
+	// Лист XLSX; по умолчанию первый
+	Sheet string `form:"sheet"`
+	// Разделитель CSV; по умолчанию запятая
+	Delimiter string `form:"delimiter" binding:"omitempty,len=1"`
+}
+
+// ImportItem - значения товара из строки импорта после слияния с найденным
+// товаром. В отличие от CreateItemRequest нулевые количество и цена допустимы:
+// в файле это обычные значения, а не пропущенные поля.
+type ImportItem struct {
+	Name        string `binding:"required"`
+	Description string
+	Quantity    int     `binding:"min=0"`
+	Price       float64 `binding:"min=0"`
+	Location    string
+}
+
+// ImportRowResult - итог по строке файла (строка 1 - заголовок)
+type ImportRowResult struct {
+	Row    int      `json:"row"`
+	Action string   `json:"action"` // create, update, unchanged, error
+	ItemID *int     `json:"item_id,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ImportResult - итог импорта; при ошибках в строках файл не применяется
+type ImportResult struct {
+	BatchID   *string           `json:"batch_id"`
+	DryRun    bool              `json:"dry_run"`
+	Applied   bool              `json:"applied"`
+	Total     int               `json:"total"`
+	Created   int               `json:"created"`
+	Updated   int               `json:"updated"`
+	Unchanged int               `json:"unchanged"`
+	Failed    int               `json:"failed"`
+	Rows      []ImportRowResult `json:"rows"`
+}
+
+// ItemBatch - пакет изменений товаров: импорт, пакетный запрос или откат пакета
+type ItemBatch struct {
+	ID           string    `json:"id" db:"id"`
+	Kind         string    `json:"kind" db:"kind"` // IMPORT, BATCH, REVERT
+	CreatedBy    string    `json:"created_by" db:"created_by"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	Source       string    `json:"source,omitempty" db:"source"`
+	CreatedCount int       `json:"created_count" db:"created_count"`
+	UpdatedCount int       `json:"updated_count" db:"updated_count"`
+	DeletedCount int       `json:"deleted_count" db:"deleted_count"`
+	// Для REVERT - отмененный пакет
+	RevertedBatchID *string `json:"reverted_batch_id,omitempty" db:"reverted_batch_id"`
+	// Пакет, которым этот пакет откатили
+	RevertedBy *string `json:"reverted_by,omitempty"`
+}
+
+// BatchOperation - операция пакетного запроса. Item - CreateItemRequest
+// для create и UpdateItemRequest для update; для update и delete нужны ID
+// и ожидаемая версия (Version или item.version).
+type BatchOperation struct {
+	Op      string          `json:"op" binding:"required,oneof=create update delete"`
+	ID      *int            `json:"id"`
+	Version *int            `json:"version"`
+	Item    json.RawMessage `json:"item"`
+}
+
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations" binding:"required,min=1,max=500,dive"`
+	// atomic (по умолчанию) - все или ничего; best_effort - неудачные
+	// операции пропускаются, остальные применяются
+	Mode string `json:"mode" binding:"omitempty,oneof=atomic best_effort"`
+}
+
+// BatchOperationResult - итог операции; status: ok, error, rolled_back
+// (успешна, но пакет не применен) или skipped (не выполнялась)
+type BatchOperationResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	Status string `json:"status"`
+	Item   *Item  `json:"item,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// HTTP-статус, который вернул бы одиночный запрос с этой ошибкой
+	Code int `json:"code,omitempty"`
+}
+
+type BatchResponse struct {
+	BatchID   *string                `json:"batch_id"`
+	Mode      string                 `json:"mode"`
+	Applied   bool                   `json:"applied"`
+	Succeeded int                    `json:"succeeded"`
+	Failed    int                    `json:"failed"`
+	Results   []BatchOperationResult `json:"results"`
+}
+
+// BatchRevertResponse - итог отката пакета
+type BatchRevertResponse struct {
+	BatchID         string `json:"batch_id"`
+	RevertedBatchID string `json:"reverted_batch_id"`
+	Reverted        int    `json:"reverted"`
+	// Записи пакета без изменений полей: откатывать в них нечего
+	Skipped []int `json:"skipped"`
+}
+
+// StockMovement - движение остатка в журнале stock_movements
+type StockMovement struct {
+	ID             int       `json:"id" db:"id"`
+	ItemID         int       `json:"item_id" db:"item_id"`
+	Type           string    `json:"type" db:"movement_type"` // RECEIPT, PICK, ADJUSTMENT, WRITE_OFF
+	Delta          int       `json:"delta" db:"quantity_delta"`
+	QuantityBefore int       `json:"quantity_before" db:"quantity_before"`
+	QuantityAfter  int       `json:"quantity_after" db:"quantity_after"`
+	ReasonCode     string    `json:"reason_code" db:"reason_code"`
+	Reference      string    `json:"reference,omitempty" db:"reference"`
+	Note           string    `json:"note,omitempty" db:"note"`
+	// Запись истории, в которой отражено изменение количества
+	HistoryID *int      `json:"history_id" db:"history_id"`
+	CreatedBy string    `json:"created_by" db:"created_by"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// StockMovementRequest - движение остатка. Delta со знаком: RECEIPT -
+// положительная, PICK и WRITE_OFF - отрицательная, ADJUSTMENT - любая
+type StockMovementRequest struct {
+	Type       string `json:"type" binding:"required,oneof=RECEIPT PICK ADJUSTMENT WRITE_OFF"`
+	Delta      int    `json:"delta" binding:"required"`
+	ReasonCode string `json:"reason_code" binding:"required,max=50"`
+	Reference  string `json:"reference" binding:"max=100"`
+	Note       string `json:"note"`
+}
+
+type StockMovementResponse struct {
+	Movement StockMovement `json:"movement"`
+	Item     Item          `json:"item"`
+}
+
+type StockMovementFilter struct {
+	Type   *string `form:"type" binding:"omitempty,oneof=RECEIPT PICK ADJUSTMENT WRITE_OFF"`
+	Limit  int     `form:"limit" binding:"omitempty,min=1,max=100"`
+	Offset int     `form:"offset" binding:"min=0"`
+}
+
+// StockMovementPage - страница журнала движений; total - без учета limit/offset
+type StockMovementPage struct {
+	Movements []StockMovement `json:"movements"`
+	Total     int             `json:"total"`
+	Limit     int             `json:"limit"`
+	Offset    int             `json:"offset"`
 }
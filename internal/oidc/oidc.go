@@ -0,0 +1,507 @@
+// Package oidc реализует вход через внешнего OpenID Connect провайдера
+// (authorization code + PKCE) без сторонних OIDC-библиотек.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+	"3.7/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrNotConfigured = errors.New("single sign-on is not configured")
+
+// Config - параметры провайдера из окружения
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	GroupsClaim  string
+	// Сопоставление групп IdP ролям; порядок задает приоритет
+	RoleMapping []GroupRole
+	// Роль для пользователей без подходящей группы; пустая - вход запрещен
+	DefaultRole models.Role
+	// Значения amr в ID token, которыми IdP подтверждает второй фактор;
+	// с ними локальный TOTP не запрашивается. Пусто - TOTP как при входе по паролю
+	MFAMethods []string
+}
+
+type GroupRole struct {
+	Group string
+	Role  models.Role
+}
+
+// ConfigFromEnv читает OIDC_* переменные; nil означает, что SSO выключен.
+// knownRole проверяет роли из OIDC_ROLE_MAPPING и OIDC_DEFAULT_ROLE
+//
+//	OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET, OIDC_REDIRECT_URL
+//	OIDC_SCOPES        - через пробел, по умолчанию "openid profile email groups"
+//	OIDC_GROUPS_CLAIM  - по умолчанию "groups"
+//	OIDC_ROLE_MAPPING  - "group=role,group=role"
+//	OIDC_DEFAULT_ROLE  - роль без подходящей группы
+//	OIDC_MFA_AMR       - через пробел значения amr, означающие, что IdP
+//	                     проверил второй фактор (например "mfa otp hwk")
+func ConfigFromEnv(knownRole func(models.Role) bool) (*Config, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	cfg := &Config{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+		GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		DefaultRole:  models.Role(os.Getenv("OIDC_DEFAULT_ROLE")),
+		MFAMethods:   strings.Fields(os.Getenv("OIDC_MFA_AMR")),
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required when OIDC_ISSUER is set")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email", "groups"}
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	for _, entry := range strings.Split(os.Getenv("OIDC_ROLE_MAPPING"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid OIDC_ROLE_MAPPING entry %q, expected group=role", entry)
+		}
+		role := models.Role(parts[1])
+		if !knownRole(role) {
+			return nil, fmt.Errorf("OIDC_ROLE_MAPPING entry %q names unknown role %q", entry, role)
+		}
+		cfg.RoleMapping = append(cfg.RoleMapping, GroupRole{Group: parts[0], Role: role})
+	}
+	if cfg.DefaultRole != "" && !knownRole(cfg.DefaultRole) {
+		return nil, fmt.Errorf("OIDC_DEFAULT_ROLE names unknown role %q", cfg.DefaultRole)
+	}
+	return cfg, nil
+}
+
+// MaxUsernameLength совпадает с users.username VARCHAR(50)
+const MaxUsernameLength = 50
+
+// username выбирает первое подходящее имя из claims. Если ни одно не подходит
+// (например, длинный email и sub), имя выводится из sub: оно короткое и
+// одинаковое при каждом входе.
+func username(candidates ...string) string {
+	for _, name := range candidates {
+		if validUsername(name) {
+			return name
+		}
+	}
+	sum := sha256.Sum256([]byte(candidates[len(candidates)-1]))
+	return "sso-" + hex.EncodeToString(sum[:8])
+}
+
+// validUsername повторяет ограничения регистрации (3-50 символов)
+// и не пропускает пробелы и управляющие символы
+func validUsername(name string) bool {
+	n := utf8.RuneCountInString(name)
+	if n < 3 || n > MaxUsernameLength || !utf8.ValidString(name) {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Provider - настроенный провайдер с документом discovery и кешем ключей
+type Provider struct {
+	Config     Config
+	HTTPClient *http.Client
+
+	mu        sync.RWMutex
+	discovery *discoveryDocument
+	keys      map[string]crypto.PublicKey
+}
+
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func NewProvider(cfg Config) *Provider {
+	return &Provider{Config: cfg, HTTPClient: &http.Client{Timeout: 10 * time.Second}}
+}
+
+var defaultProvider *Provider
+
+// Init включает SSO, если он настроен в окружении
+func Init(knownRole func(models.Role) bool) error {
+	cfg, err := ConfigFromEnv(knownRole)
+	if err != nil || cfg == nil {
+		return err
+	}
+	defaultProvider = NewProvider(*cfg)
+	return nil
+}
+
+// Default возвращает провайдер из окружения
+func Default() (*Provider, error) {
+	if defaultProvider == nil {
+		return nil, ErrNotConfigured
+	}
+	return defaultProvider, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, rawURL string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover загружает документ discovery один раз (при неудаче - повторит позже)
+func (p *Provider) discover(ctx context.Context) (*discoveryDocument, error) {
+	p.mu.RLock()
+	doc := p.discovery
+	p.mu.RUnlock()
+	if doc != nil {
+		return doc, nil
+	}
+
+	doc = &discoveryDocument{}
+	if err := p.getJSON(ctx, p.Config.Issuer+"/.well-known/openid-configuration", doc); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != p.Config.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer mismatch %q", doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: incomplete provider metadata")
+	}
+
+	p.mu.Lock()
+	p.discovery = doc
+	p.mu.Unlock()
+	return doc, nil
+}
+
+// RandomString возвращает криптостойкую строку в base64url
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge вычисляет PKCE code_challenge (S256) для verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL формирует адрес перенаправления на страницу входа IdP
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	doc, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.Config.ClientID)
+	v.Set("redirect_uri", p.Config.RedirectURL)
+	v.Set("scope", strings.Join(p.Config.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", CodeChallenge(verifier))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return doc.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange обменивает код авторизации на ID token
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	doc, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.Config.RedirectURL)
+	form.Set("client_id", p.Config.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+	}
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("oidc token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("oidc token exchange failed: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("oidc token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// Identity - проверенные сведения о пользователе из ID token
+type Identity struct {
+	Subject  string
+	Username string
+	Email    string
+	Groups   []string
+	// Методы аутентификации из claim amr (RFC 8176)
+	AMR []string
+}
+
+// VerifyIDToken проверяет подпись, issuer, audience, срок и nonce ID token
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(p.Config.Issuer),
+		jwt.WithAudience(p.Config.ClientID),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %w", err)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("invalid id_token: missing exp")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("invalid id_token: nonce mismatch")
+	}
+
+	id := &Identity{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	if id.Subject == "" {
+		return nil, errors.New("invalid id_token: missing sub")
+	}
+	preferred, _ := claims["preferred_username"].(string)
+	id.Username = username(preferred, id.Email, id.Subject)
+
+	switch groups := claims[p.Config.GroupsClaim].(type) {
+	case string:
+		id.Groups = []string{groups}
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+	if amr, ok := claims["amr"].([]interface{}); ok {
+		for _, m := range amr {
+			if s, ok := m.(string); ok {
+				id.AMR = append(id.AMR, s)
+			}
+		}
+	}
+	return id, nil
+}
+
+// SecondFactorVerified сообщает, что IdP проверил второй фактор: amr токена
+// содержит один из методов MFAMethods
+func (p *Provider) SecondFactorVerified(id *Identity) bool {
+	for _, want := range p.Config.MFAMethods {
+		for _, m := range id.AMR {
+			if m == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MapRole выбирает роль по первой подходящей группе из RoleMapping
+func (p *Provider) MapRole(groups []string) (models.Role, bool) {
+	for _, m := range p.Config.RoleMapping {
+		for _, g := range groups {
+			if g == m.Group {
+				return m.Role, true
+			}
+		}
+	}
+	if p.Config.DefaultRole != "" {
+		return p.Config.DefaultRole, true
+	}
+	return "", false
+}
+
+// publicKey ищет ключ по kid; незнакомый kid приводит к перезагрузке JWKS
+func (p *Provider) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.RLock()
+	key, ok := p.keys[kid]
+	p.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	doc, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, doc.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	// Провайдер с единственным ключом может не указывать kid
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("oidc jwks: unknown key id %q", kid)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
@@ -0,0 +1,571 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"3.7/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeIdP - локальный провайдер: discovery, JWKS и token endpoint с PKCE
+type fakeIdP struct {
+	srv *httptest.Server
+
+	mu sync.Mutex
+	// issuer в документе discovery; пустой - адрес сервера
+	issuer     string
+	keys       map[string]*rsa.PrivateKey
+	challenges map[string]string // code -> code_challenge
+	idToken    string
+
+	discoveryHits int
+	jwksHits      int
+}
+
+const (
+	testClientID     = "inventory"
+	testClientSecret = "s3cret"
+	testRedirectURL  = "http://app.test/api/auth/oidc/callback"
+)
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	f := &fakeIdP{keys: map[string]*rsa.PrivateKey{}, challenges: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", f.discovery)
+	mux.HandleFunc("/jwks", f.jwks)
+	mux.HandleFunc("/token", f.token)
+	f.srv = httptest.NewServer(mux)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.discoveryHits++
+	issuer := f.issuer
+	if issuer == "" {
+		issuer = f.srv.URL
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 issuer,
+		"authorization_endpoint": f.srv.URL + "/authorize",
+		"token_endpoint":         f.srv.URL + "/token",
+		"jwks_uri":               f.srv.URL + "/jwks",
+	})
+}
+
+func (f *fakeIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.jwksHits++
+	var keys []map[string]string
+	for kid, key := range f.keys {
+		keys = append(keys, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (f *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	if err := r.ParseForm(); err != nil || r.Method != http.MethodPost {
+		fail("invalid_request")
+		return
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != testClientID || pass != testClientSecret {
+		fail("invalid_client")
+		return
+	}
+	challenge, ok := f.challenges[r.PostForm.Get("code")]
+	if r.PostForm.Get("grant_type") != "authorization_code" || !ok ||
+		r.PostForm.Get("redirect_uri") != testRedirectURL ||
+		CodeChallenge(r.PostForm.Get("code_verifier")) != challenge {
+		fail("invalid_grant")
+		return
+	}
+	delete(f.challenges, r.PostForm.Get("code"))
+	json.NewEncoder(w).Encode(map[string]string{"id_token": f.idToken, "token_type": "Bearer"})
+}
+
+// addKey публикует новый ключ подписи в JWKS
+func (f *fakeIdP) addKey(t *testing.T, kid string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.keys[kid] = key
+	f.mu.Unlock()
+}
+
+// sign подписывает ID token ключом kid
+func (f *fakeIdP) sign(t *testing.T, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	f.mu.Lock()
+	key := f.keys[kid]
+	f.mu.Unlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// claims - корректный набор утверждений ID token для провайдера
+func (f *fakeIdP) claims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":                f.srv.URL,
+		"aud":                testClientID,
+		"sub":                "user-42",
+		"preferred_username": "jdoe",
+		"email":              "jdoe@example.com",
+		"groups":             []string{"warehouse", "staff"},
+		"nonce":              nonce,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+	}
+}
+
+func (f *fakeIdP) provider() *Provider {
+	return NewProvider(Config{
+		Issuer:       f.srv.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+		Scopes:       []string{"openid", "groups"},
+		GroupsClaim:  "groups",
+	})
+}
+
+func TestAuthCodeURLUsesDiscovery(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider()
+	ctx := context.Background()
+
+	raw, err := p.AuthCodeURL(ctx, "state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != idp.srv.URL+"/authorize" {
+		t.Errorf("authorization endpoint = %s", got)
+	}
+	q := u.Query()
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid groups",
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        CodeChallenge("verifier-1"),
+		"code_challenge_method": "S256",
+	}
+	for k, v := range want {
+		if q.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, q.Get(k), v)
+		}
+	}
+
+	// Документ discovery кешируется
+	if _, err := p.AuthCodeURL(ctx, "state-2", "nonce-2", "verifier-2"); err != nil {
+		t.Fatal(err)
+	}
+	if idp.discoveryHits != 1 {
+		t.Errorf("discovery fetched %d times, want 1", idp.discoveryHits)
+	}
+}
+
+func TestDiscoveryRejectsIssuerMismatch(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.issuer = "https://evil.example.com"
+
+	_, err := idp.provider().AuthCodeURL(context.Background(), "s", "n", "v")
+	if err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Fatalf("err = %v, want issuer mismatch", err)
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// S256: base64url без дополнения от SHA-256 - всегда 43 символа
+	got := CodeChallenge("verifier")
+	if len(got) != 43 || strings.ContainsAny(got, "+/=") {
+		t.Errorf("CodeChallenge = %q, want 43 base64url characters", got)
+	}
+	if CodeChallenge("verifier") != got {
+		t.Error("CodeChallenge is not deterministic")
+	}
+	if CodeChallenge("verifier2") == got {
+		t.Error("different verifiers give the same challenge")
+	}
+}
+
+func TestExchangePKCE(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.addKey(t, "k1")
+	p := idp.provider()
+	ctx := context.Background()
+
+	verifier, err := RandomString(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := p.AuthCodeURL(ctx, "state", "nonce", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(raw)
+	idp.challenges["code-ok"] = u.Query().Get("code_challenge")
+	idp.challenges["code-bad"] = u.Query().Get("code_challenge")
+	idp.idToken = idp.sign(t, "k1", idp.claims("nonce"))
+
+	idToken, err := p.Exchange(ctx, "code-ok", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := p.VerifyIDToken(ctx, idToken, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Subject != "user-42" || id.Username != "jdoe" || id.Email != "jdoe@example.com" {
+		t.Errorf("identity = %+v", id)
+	}
+	if len(id.Groups) != 2 || id.Groups[0] != "warehouse" {
+		t.Errorf("groups = %v", id.Groups)
+	}
+
+	// Код одноразовый
+	if _, err := p.Exchange(ctx, "code-ok", verifier); err == nil {
+		t.Error("reused code accepted")
+	}
+	// Чужой verifier не проходит проверку PKCE
+	if _, err := p.Exchange(ctx, "code-bad", "another-verifier"); err == nil ||
+		!strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("err = %v, want invalid_grant", err)
+	}
+}
+
+func TestExchangeRequiresClientSecret(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider()
+	p.Config.ClientSecret = "wrong"
+	idp.challenges["code"] = CodeChallenge("v")
+
+	if _, err := p.Exchange(context.Background(), "code", "v"); err == nil ||
+		!strings.Contains(err.Error(), "invalid_client") {
+		t.Fatalf("err = %v, want invalid_client", err)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.addKey(t, "k1")
+	idp.addKey(t, "unpublished")
+	p := idp.provider()
+
+	tests := []struct {
+		name   string
+		kid    string
+		modify func(jwt.MapClaims)
+		nonce  string
+		err    string
+	}{
+		{name: "valid", kid: "k1", modify: func(jwt.MapClaims) {}, nonce: "n"},
+		{name: "bad issuer", kid: "k1", modify: func(c jwt.MapClaims) { c["iss"] = "https://other.example.com" }, nonce: "n", err: "issuer"},
+		{name: "bad audience", kid: "k1", modify: func(c jwt.MapClaims) { c["aud"] = "another-client" }, nonce: "n", err: "audience"},
+		{name: "nonce mismatch", kid: "k1", modify: func(jwt.MapClaims) {}, nonce: "other", err: "nonce mismatch"},
+		{name: "missing nonce", kid: "k1", modify: func(c jwt.MapClaims) { delete(c, "nonce") }, nonce: "n", err: "nonce mismatch"},
+		{name: "expired", kid: "k1", modify: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }, nonce: "n", err: "expired"},
+		{name: "within leeway", kid: "k1", modify: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() }, nonce: "n"},
+		{name: "missing exp", kid: "k1", modify: func(c jwt.MapClaims) { delete(c, "exp") }, nonce: "n", err: "missing exp"},
+		{name: "missing sub", kid: "k1", modify: func(c jwt.MapClaims) { delete(c, "sub") }, nonce: "n", err: "missing sub"},
+		{name: "unknown key", kid: "unpublished", modify: func(jwt.MapClaims) {}, nonce: "n", err: "unknown key id"},
+	}
+	// Ключ unpublished подписывает, но в JWKS его нет
+	idp.mu.Lock()
+	unpublished := idp.keys["unpublished"]
+	delete(idp.keys, "unpublished")
+	idp.mu.Unlock()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idp.claims("n")
+			tt.modify(claims)
+			if tt.kid == "unpublished" {
+				idp.mu.Lock()
+				idp.keys["unpublished"] = unpublished
+				idp.mu.Unlock()
+			}
+			raw := idp.sign(t, tt.kid, claims)
+			if tt.kid == "unpublished" {
+				idp.mu.Lock()
+				delete(idp.keys, "unpublished")
+				idp.mu.Unlock()
+			}
+
+			_, err := p.VerifyIDToken(context.Background(), raw, tt.nonce)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenRejectsHMAC(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.addKey(t, "k1")
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, idp.claims("n"))
+	token.Header["kid"] = "k1"
+	raw, err := token.SignedString([]byte(testClientSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idp.provider().VerifyIDToken(context.Background(), raw, "n"); err == nil {
+		t.Fatal("HS256 token accepted")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.addKey(t, "k1")
+	p := idp.provider()
+	ctx := context.Background()
+
+	old := idp.sign(t, "k1", idp.claims("n"))
+	if _, err := p.VerifyIDToken(ctx, old, "n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.VerifyIDToken(ctx, old, "n"); err != nil {
+		t.Fatal(err)
+	}
+	if idp.jwksHits != 1 {
+		t.Fatalf("jwks fetched %d times, want 1 (cached)", idp.jwksHits)
+	}
+
+	// IdP выпускает новый ключ и отзывает старый: незнакомый kid
+	// перезагружает JWKS
+	idp.addKey(t, "k2")
+	idp.mu.Lock()
+	delete(idp.keys, "k1")
+	idp.mu.Unlock()
+
+	rotated := idp.sign(t, "k2", idp.claims("n"))
+	if _, err := p.VerifyIDToken(ctx, rotated, "n"); err != nil {
+		t.Fatalf("token with rotated key: %v", err)
+	}
+	if idp.jwksHits != 2 {
+		t.Errorf("jwks fetched %d times, want 2", idp.jwksHits)
+	}
+
+	// Отозванный ключ больше не принимается
+	if _, err := p.VerifyIDToken(ctx, old, "n"); err == nil ||
+		!strings.Contains(err.Error(), "unknown key id") {
+		t.Errorf("err = %v, want unknown key id", err)
+	}
+}
+
+func TestMapRole(t *testing.T) {
+	mapping := []GroupRole{
+		{Group: "inventory-admins", Role: models.Role("admin")},
+		{Group: "warehouse", Role: models.Role("manager")},
+	}
+	tests := []struct {
+		name        string
+		groups      []string
+		defaultRole models.Role
+		want        models.Role
+		ok          bool
+	}{
+		{name: "single match", groups: []string{"warehouse"}, want: "manager", ok: true},
+		{name: "mapping order wins", groups: []string{"warehouse", "inventory-admins"}, want: "admin", ok: true},
+		{name: "no match without default", groups: []string{"sales"}, ok: false},
+		{name: "no groups without default", groups: nil, ok: false},
+		{name: "default role", groups: []string{"sales"}, defaultRole: "viewer", want: "viewer", ok: true},
+		{name: "match beats default", groups: []string{"warehouse"}, defaultRole: "viewer", want: "manager", ok: true},
+		{name: "case sensitive", groups: []string{"Warehouse"}, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProvider(Config{RoleMapping: mapping, DefaultRole: tt.defaultRole})
+			got, ok := p.MapRole(tt.groups)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("MapRole(%v) = %q, %v; want %q, %v", tt.groups, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSecondFactorVerified(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.addKey(t, "k1")
+	p := idp.provider()
+	p.Config.MFAMethods = []string{"mfa", "hwk"}
+
+	tests := []struct {
+		name string
+		amr  interface{}
+		want bool
+	}{
+		{name: "mfa", amr: []string{"pwd", "mfa"}, want: true},
+		{name: "hardware key", amr: []string{"hwk"}, want: true},
+		{name: "password only", amr: []string{"pwd"}, want: false},
+		{name: "no amr", amr: nil, want: false},
+		{name: "amr not an array", amr: "mfa", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idp.claims("n")
+			if tt.amr != nil {
+				claims["amr"] = tt.amr
+			}
+			id, err := p.VerifyIDToken(context.Background(), idp.sign(t, "k1", claims), "n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.SecondFactorVerified(id); got != tt.want {
+				t.Errorf("SecondFactorVerified(amr=%v) = %v, want %v", id.AMR, got, tt.want)
+			}
+		})
+	}
+
+	// Без OIDC_MFA_AMR второй фактор IdP не учитывается
+	p.Config.MFAMethods = nil
+	if p.SecondFactorVerified(&Identity{AMR: []string{"mfa"}}) {
+		t.Error("second factor trusted without configured MFA methods")
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("OIDC_ISSUER", "https://idp.example.com/")
+	t.Setenv("OIDC_CLIENT_ID", testClientID)
+	t.Setenv("OIDC_REDIRECT_URL", testRedirectURL)
+	t.Setenv("OIDC_ROLE_MAPPING", "admins=admin, warehouse=manager")
+	knownRole := func(role models.Role) bool { return role == "admin" || role == "manager" }
+
+	cfg, err := ConfigFromEnv(knownRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Issuer != "https://idp.example.com" {
+		t.Errorf("issuer = %q, want trailing slash trimmed", cfg.Issuer)
+	}
+	if cfg.GroupsClaim != "groups" || len(cfg.Scopes) != 4 {
+		t.Errorf("defaults not applied: %+v", cfg)
+	}
+	if len(cfg.RoleMapping) != 2 || cfg.RoleMapping[1] != (GroupRole{"warehouse", "manager"}) {
+		t.Errorf("role mapping = %+v", cfg.RoleMapping)
+	}
+	if len(cfg.MFAMethods) != 0 {
+		t.Errorf("MFA methods = %v, want none by default", cfg.MFAMethods)
+	}
+
+	t.Setenv("OIDC_MFA_AMR", "mfa  otp")
+	cfg, err = ConfigFromEnv(knownRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.MFAMethods) != 2 || cfg.MFAMethods[1] != "otp" {
+		t.Errorf("MFA methods = %v, want [mfa otp]", cfg.MFAMethods)
+	}
+
+	t.Setenv("OIDC_ROLE_MAPPING", "admins")
+	if _, err := ConfigFromEnv(knownRole); err == nil {
+		t.Error("invalid mapping accepted")
+	}
+
+	// Роли, которых нет в таблице roles, отклоняются при старте, а не при входе
+	t.Setenv("OIDC_ROLE_MAPPING", "admins=admin, ops=operator")
+	if _, err := ConfigFromEnv(knownRole); err == nil || !strings.Contains(err.Error(), "operator") {
+		t.Errorf("unknown mapped role: err = %v", err)
+	}
+	t.Setenv("OIDC_ROLE_MAPPING", "admins=admin")
+	t.Setenv("OIDC_DEFAULT_ROLE", "guest")
+	if _, err := ConfigFromEnv(knownRole); err == nil || !strings.Contains(err.Error(), "guest") {
+		t.Errorf("unknown default role: err = %v", err)
+	}
+}
+
+func TestIdentityUsername(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.addKey(t, "k1")
+	p := idp.provider()
+
+	longEmail := strings.Repeat("a", 45) + "@example.com"
+	longSub := strings.Repeat("s", 60)
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   string
+	}{
+		{"preferred username", map[string]interface{}{"preferred_username": "jdoe", "email": "jdoe@example.com"}, "jdoe"},
+		{"email fallback", map[string]interface{}{"email": "jdoe@example.com"}, "jdoe@example.com"},
+		{"long email skipped", map[string]interface{}{"email": longEmail}, "user-42"},
+		{"spaces skipped", map[string]interface{}{"preferred_username": "John Doe", "email": "jdoe@example.com"}, "jdoe@example.com"},
+		{"too short", map[string]interface{}{"preferred_username": "jd"}, "user-42"},
+		{"derived from long sub", map[string]interface{}{"sub": longSub, "email": longEmail}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idp.claims("n")
+			delete(claims, "preferred_username")
+			delete(claims, "email")
+			for k, v := range tt.claims {
+				claims[k] = v
+			}
+			identity, err := p.VerifyIDToken(context.Background(), idp.sign(t, "k1", claims), "n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != "" && identity.Username != tt.want {
+				t.Errorf("username = %q, want %q", identity.Username, tt.want)
+			}
+			if n := len(identity.Username); n < 3 || n > MaxUsernameLength {
+				t.Errorf("username %q has length %d", identity.Username, n)
+			}
+		})
+	}
+
+	// Выведенное имя стабильно между входами
+	if username(longSub) != username(longSub) || !strings.HasPrefix(username(longSub), "sso-") {
+		t.Errorf("derived username = %q", username(longSub))
+	}
+}
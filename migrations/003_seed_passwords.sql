@@ -0,0 +1,5 @@
+-- Тестовые пользователи из 001_init.sql получили невалидный bcrypt-хеш,
+-- поэтому войти под ними было невозможно. Пароль по умолчанию: changeme
+UPDATE users
+SET password_hash = '$2a$14$UfOa6KMWB5jHiTm7LXuMqemv/TBUiKNDlxCdAKnZUZIXa0H6ZWKPm'
+WHERE password_hash = '$2a$14$5Y5G5h5j5k5l5m5n5o5p5q5r5s5t5u5v5w5x5y5z5A5B5C5D5E5F5G5H5I';
@@ -0,0 +1,56 @@
+-- Роли и права вместо жестко заданного списка в коде
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(50) PRIMARY KEY,
+    description TEXT,
+    is_system BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+    name VARCHAR(50) PRIMARY KEY,
+    description TEXT
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role VARCHAR(50) REFERENCES roles(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    permission VARCHAR(50) REFERENCES permissions(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO permissions (name, description) VALUES
+    ('create', 'Create items'),
+    ('read', 'View items'),
+    ('update', 'Edit items'),
+    ('delete', 'Delete items'),
+    ('history', 'View change history'),
+    ('manage_roles', 'Manage roles and their permissions')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO roles (name, description, is_system) VALUES
+    ('admin', 'Full access', TRUE),
+    ('manager', 'Manages inventory', TRUE),
+    ('viewer', 'Read-only access', TRUE),
+    ('auditor', 'Reads inventory and history', TRUE)
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'create'),
+    ('admin', 'read'),
+    ('admin', 'update'),
+    ('admin', 'delete'),
+    ('admin', 'history'),
+    ('admin', 'manage_roles'),
+    ('manager', 'create'),
+    ('manager', 'read'),
+    ('manager', 'update'),
+    ('manager', 'history'),
+    ('viewer', 'read'),
+    ('auditor', 'read'),
+    ('auditor', 'history')
+ON CONFLICT DO NOTHING;
+
+-- Роль пользователя теперь ссылается на таблицу ролей
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+ALTER TABLE users ALTER COLUMN role TYPE VARCHAR(50);
+ALTER TABLE users
+    ADD CONSTRAINT users_role_fkey FOREIGN KEY (role) REFERENCES roles(name) ON UPDATE CASCADE;
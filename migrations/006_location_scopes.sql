@@ -0,0 +1,16 @@
+-- Зоны склада, в пределах которых пользователь может работать с товарами.
+-- Пользователь без записей в этой таблице не ограничен по локациям.
+CREATE TABLE IF NOT EXISTS user_location_scopes (
+    username VARCHAR(50) REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    location VARCHAR(100) NOT NULL,
+    is_prefix BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (username, location, is_prefix)
+);
+
+INSERT INTO permissions (name, description) VALUES
+    ('manage_users', 'Manage user accounts and their location scopes')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'manage_users')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,8 @@
+-- Откат изменений истории выделен в отдельное право
+INSERT INTO permissions (name, description) VALUES
+    ('revert', 'Revert changes from item history')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'revert')
+ON CONFLICT DO NOTHING;
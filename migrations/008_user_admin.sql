@@ -0,0 +1,19 @@
+-- Отключение учетных записей
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+
+-- Журнал изменений пользователей (по аналогии с item_history).
+-- Хеши паролей в журнал не попадают.
+CREATE TABLE IF NOT EXISTS user_history (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(50) NOT NULL,
+    action VARCHAR(20) NOT NULL CHECK (action IN ('CREATE', 'UPDATE', 'PASSWORD_RESET', 'DISABLE', 'ENABLE')),
+    changed_by VARCHAR(50) REFERENCES users(username) ON UPDATE CASCADE,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    old_data JSONB,
+    new_data JSONB,
+    changes JSONB
+);
+
+CREATE INDEX idx_user_history_username ON user_history(username);
+CREATE INDEX idx_user_history_changed_at ON user_history(changed_at);
@@ -0,0 +1,25 @@
+-- Долгоживущие ключи для сканеров и интеграций. Ключ действует от имени
+-- пользователя username и только в пределах перечисленных прав.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    key_prefix VARCHAR(16) NOT NULL,
+    key_hash VARCHAR(64) NOT NULL UNIQUE,
+    username VARCHAR(50) NOT NULL REFERENCES users(username) ON UPDATE CASCADE,
+    permissions TEXT[] NOT NULL DEFAULT '{}',
+    created_by VARCHAR(50) REFERENCES users(username) ON UPDATE CASCADE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_api_keys_username ON api_keys(username);
+
+INSERT INTO permissions (name, description) VALUES
+    ('manage_api_keys', 'Issue and revoke API keys')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'manage_api_keys')
+ON CONFLICT DO NOTHING;
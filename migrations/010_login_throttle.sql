@@ -0,0 +1,17 @@
+-- Счетчики неудачных входов по логину и по IP. Хранятся в БД, чтобы
+-- переживать перезапуск сервиса.
+CREATE TABLE IF NOT EXISTS login_throttle (
+    scope VARCHAR(10) NOT NULL CHECK (scope IN ('user', 'ip')),
+    key VARCHAR(255) NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    blocked_until TIMESTAMP,
+    PRIMARY KEY (scope, key)
+);
+
+-- Временная блокировка учетной записи; снимается по времени или администратором
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
+
+ALTER TABLE user_history DROP CONSTRAINT IF EXISTS user_history_action_check;
+ALTER TABLE user_history ADD CONSTRAINT user_history_action_check
+    CHECK (action IN ('CREATE', 'UPDATE', 'PASSWORD_RESET', 'DISABLE', 'ENABLE', 'UNLOCK'));
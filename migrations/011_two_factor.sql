@@ -0,0 +1,29 @@
+-- TOTP (RFC 6238). Секрет нужен в открытом виде для проверки кодов.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_pending_secret VARCHAR(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMP;
+-- Последний принятый временной шаг: один код нельзя использовать дважды
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+-- Одноразовые коды восстановления (хранятся хешами)
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    username VARCHAR(50) REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    used_at TIMESTAMP,
+    PRIMARY KEY (username, code_hash)
+);
+
+-- Промежуточное состояние входа между паролем и вторым фактором
+CREATE TABLE IF NOT EXISTS login_challenges (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    username VARCHAR(50) NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+    purpose VARCHAR(10) NOT NULL CHECK (purpose IN ('verify', 'enroll')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Политика: для каких ролей второй фактор обязателен
+ALTER TABLE roles ADD COLUMN IF NOT EXISTS requires_2fa BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE roles SET requires_2fa = TRUE WHERE name IN ('admin', 'manager');
@@ -0,0 +1,15 @@
+-- Вход через OpenID Connect: состояние между редиректом на IdP и callback
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+    state_hash VARCHAR(64) PRIMARY KEY,
+    code_verifier VARCHAR(128) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Откуда пришла учетная запись. У пользователей SSO нет локального пароля,
+-- а связь с IdP держится на неизменяемом sub, а не на имени.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS auth_provider VARCHAR(20) NOT NULL DEFAULT 'local';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS external_subject VARCHAR(255);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_external_subject
+    ON users(auth_provider, external_subject) WHERE external_subject IS NOT NULL;
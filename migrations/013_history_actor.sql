@@ -0,0 +1,75 @@
+-- Автор изменения в item_history. Раньше changed_by брался из created_by,
+-- и любое изменение приписывалось создателю товара. Теперь приложение
+-- передает пользователя в транзакцию через app.current_user
+-- (set_config(..., true) действует до конца транзакции).
+CREATE OR REPLACE FUNCTION log_item_changes()
+RETURNS TRIGGER AS $$
+DECLARE
+    changes JSONB;
+    old_json JSONB;
+    new_json JSONB;
+    actor VARCHAR(50);
+BEGIN
+    -- Определяем действие
+    IF TG_OP = 'INSERT' THEN
+        old_json := NULL;
+        new_json := to_jsonb(NEW);
+        changes := to_jsonb(NEW);
+    ELSIF TG_OP = 'UPDATE' THEN
+        old_json := to_jsonb(OLD);
+        new_json := to_jsonb(NEW);
+        
+        -- Собираем только измененные поля
+        changes := '{}'::JSONB;
+        IF OLD.name IS DISTINCT FROM NEW.name THEN
+            changes := changes || jsonb_build_object('name', jsonb_build_object('old', OLD.name, 'new', NEW.name));
+        END IF;
+        IF OLD.description IS DISTINCT FROM NEW.description THEN
+            changes := changes || jsonb_build_object('description', jsonb_build_object('old', OLD.description, 'new', NEW.description));
+        END IF;
+        IF OLD.quantity IS DISTINCT FROM NEW.quantity THEN
+            changes := changes || jsonb_build_object('quantity', jsonb_build_object('old', OLD.quantity, 'new', NEW.quantity));
+        END IF;
+        IF OLD.price IS DISTINCT FROM NEW.price THEN
+            changes := changes || jsonb_build_object('price', jsonb_build_object('old', OLD.price, 'new', NEW.price));
+        END IF;
+        IF OLD.location IS DISTINCT FROM NEW.location THEN
+            changes := changes || jsonb_build_object('location', jsonb_build_object('old', OLD.location, 'new', NEW.location));
+        END IF;
+    ELSIF TG_OP = 'DELETE' THEN
+        old_json := to_jsonb(OLD);
+        new_json := NULL;
+        changes := to_jsonb(OLD);
+    END IF;
+
+    -- Изменение вне приложения (без app.current_user) остается без автора,
+    -- кроме создания, где автор известен из created_by
+    actor := NULLIF(current_setting('app.current_user', true), '');
+    IF actor IS NULL AND TG_OP = 'INSERT' THEN
+        actor := NEW.created_by;
+    END IF;
+    
+    -- Вставляем запись в историю
+    INSERT INTO item_history (
+        item_id,
+        action,
+        changed_by,
+        old_data,
+        new_data,
+        changes
+    ) VALUES (
+        COALESCE(NEW.id, OLD.id),
+        CASE TG_OP WHEN 'INSERT' THEN 'CREATE' ELSE TG_OP END,
+        actor,
+        old_json,
+        new_json,
+        changes
+    );
+    
+    RETURN COALESCE(NEW, OLD);
+END;
+$$ LANGUAGE plpgsql;
+
+-- История должна переживать удаление товара: запись о DELETE ссылается
+-- на уже удаленную строку, а каскад стер бы весь журнал товара
+ALTER TABLE item_history DROP CONSTRAINT IF EXISTS item_history_item_id_fkey;
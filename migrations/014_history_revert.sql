@@ -0,0 +1,85 @@
+-- Откат изменений как полноценное действие истории
+ALTER TABLE item_history DROP CONSTRAINT IF EXISTS item_history_action_check;
+ALTER TABLE item_history ADD CONSTRAINT item_history_action_check
+    CHECK (action IN ('CREATE', 'UPDATE', 'DELETE', 'REVERT'));
+
+ALTER TABLE item_history ADD COLUMN IF NOT EXISTS reverted_history_id INTEGER REFERENCES item_history(id);
+CREATE INDEX IF NOT EXISTS idx_item_history_reverted ON item_history(reverted_history_id);
+
+CREATE OR REPLACE FUNCTION log_item_changes()
+RETURNS TRIGGER AS $$
+DECLARE
+    changes JSONB;
+    old_json JSONB;
+    new_json JSONB;
+    actor VARCHAR(50);
+    history_action VARCHAR(20);
+BEGIN
+    -- Определяем действие
+    IF TG_OP = 'INSERT' THEN
+        old_json := NULL;
+        new_json := to_jsonb(NEW);
+        changes := to_jsonb(NEW);
+    ELSIF TG_OP = 'UPDATE' THEN
+        old_json := to_jsonb(OLD);
+        new_json := to_jsonb(NEW);
+        
+        -- Собираем только измененные поля
+        changes := '{}'::JSONB;
+        IF OLD.name IS DISTINCT FROM NEW.name THEN
+            changes := changes || jsonb_build_object('name', jsonb_build_object('old', OLD.name, 'new', NEW.name));
+        END IF;
+        IF OLD.description IS DISTINCT FROM NEW.description THEN
+            changes := changes || jsonb_build_object('description', jsonb_build_object('old', OLD.description, 'new', NEW.description));
+        END IF;
+        IF OLD.quantity IS DISTINCT FROM NEW.quantity THEN
+            changes := changes || jsonb_build_object('quantity', jsonb_build_object('old', OLD.quantity, 'new', NEW.quantity));
+        END IF;
+        IF OLD.price IS DISTINCT FROM NEW.price THEN
+            changes := changes || jsonb_build_object('price', jsonb_build_object('old', OLD.price, 'new', NEW.price));
+        END IF;
+        IF OLD.location IS DISTINCT FROM NEW.location THEN
+            changes := changes || jsonb_build_object('location', jsonb_build_object('old', OLD.location, 'new', NEW.location));
+        END IF;
+    ELSIF TG_OP = 'DELETE' THEN
+        old_json := to_jsonb(OLD);
+        new_json := NULL;
+        changes := to_jsonb(OLD);
+    END IF;
+
+    -- Изменение вне приложения (без app.current_user) остается без автора,
+    -- кроме создания, где автор известен из created_by
+    actor := NULLIF(current_setting('app.current_user', true), '');
+    IF actor IS NULL AND TG_OP = 'INSERT' THEN
+        actor := NEW.created_by;
+    END IF;
+    
+    -- Откат помечается приложением: запись получает действие REVERT
+    -- и ссылку на отмененную запись истории
+    history_action := CASE TG_OP WHEN 'INSERT' THEN 'CREATE' ELSE TG_OP END;
+    IF current_setting('app.history_action', true) = 'REVERT' THEN
+        history_action := 'REVERT';
+    END IF;
+    
+    -- Вставляем запись в историю
+    INSERT INTO item_history (
+        item_id,
+        action,
+        changed_by,
+        old_data,
+        new_data,
+        changes,
+        reverted_history_id
+    ) VALUES (
+        COALESCE(NEW.id, OLD.id),
+        history_action,
+        actor,
+        old_json,
+        new_json,
+        changes,
+        NULLIF(current_setting('app.reverted_history_id', true), '')::INTEGER
+    );
+    
+    RETURN COALESCE(NEW, OLD);
+END;
+$$ LANGUAGE plpgsql;
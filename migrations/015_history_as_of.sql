@@ -0,0 +1,3 @@
+-- Восстановление состояния на момент времени ищет последнюю запись товара не позже ts
+CREATE INDEX IF NOT EXISTS idx_item_history_item_as_of
+    ON item_history(item_id, changed_at DESC, id DESC);
@@ -0,0 +1,88 @@
+-- Пакеты изменений: все записи истории одного импорта ссылаются на пакет,
+-- чтобы изменения можно было просмотреть вместе
+CREATE TABLE IF NOT EXISTS item_batches (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    kind VARCHAR(20) NOT NULL CHECK (kind IN ('IMPORT')),
+    created_by VARCHAR(50) REFERENCES users(username),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    -- Имя загруженного файла
+    source VARCHAR(255),
+    created_count INTEGER NOT NULL DEFAULT 0,
+    updated_count INTEGER NOT NULL DEFAULT 0
+);
+
+ALTER TABLE item_history ADD COLUMN IF NOT EXISTS batch_id UUID REFERENCES item_batches(id);
+CREATE INDEX IF NOT EXISTS idx_item_history_batch ON item_history(batch_id);
+
+-- Импорт выделен в отдельное право
+INSERT INTO permissions (name, description) VALUES
+    ('import', 'Bulk import items from CSV/XLSX files')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'import'),
+    ('manager', 'import')
+ON CONFLICT DO NOTHING;
+
+-- Пакет передается приложением через app.batch_id, как автор - через app.current_user
+CREATE OR REPLACE FUNCTION log_item_changes()
+RETURNS TRIGGER AS $$
+DECLARE
+    changes JSONB;
+    old_json JSONB;
+    new_json JSONB;
+    actor VARCHAR(50);
+    history_action VARCHAR(20);
+BEGIN
+    old_json := CASE WHEN TG_OP = 'INSERT' THEN NULL ELSE to_jsonb(OLD) END;
+    new_json := CASE WHEN TG_OP = 'DELETE' THEN NULL ELSE to_jsonb(NEW) END;
+
+    -- Изменения считаются по всем колонкам снимков в виде пар old/new,
+    -- одинаково для создания, изменения и удаления. updated_at меняется
+    -- при любом изменении и в changes не попадает.
+    SELECT COALESCE(jsonb_object_agg(k.key, jsonb_build_object(
+               'old', COALESCE(old_json, '{}'::JSONB) -> k.key,
+               'new', COALESCE(new_json, '{}'::JSONB) -> k.key)), '{}'::JSONB)
+    INTO changes
+    FROM jsonb_object_keys(COALESCE(old_json, '{}'::JSONB) || COALESCE(new_json, '{}'::JSONB)) AS k(key)
+    WHERE k.key <> 'updated_at'
+      AND (COALESCE(old_json, '{}'::JSONB) -> k.key) IS DISTINCT FROM (COALESCE(new_json, '{}'::JSONB) -> k.key);
+
+    -- Изменение вне приложения (без app.current_user) остается без автора,
+    -- кроме создания, где автор известен из created_by
+    actor := NULLIF(current_setting('app.current_user', true), '');
+    IF actor IS NULL AND TG_OP = 'INSERT' THEN
+        actor := NEW.created_by;
+    END IF;
+    
+    -- Откат помечается приложением: запись получает действие REVERT
+    -- и ссылку на отмененную запись истории
+    history_action := CASE TG_OP WHEN 'INSERT' THEN 'CREATE' ELSE TG_OP END;
+    IF current_setting('app.history_action', true) = 'REVERT' THEN
+        history_action := 'REVERT';
+    END IF;
+    
+    -- Вставляем запись в историю
+    INSERT INTO item_history (
+        item_id,
+        action,
+        changed_by,
+        old_data,
+        new_data,
+        changes,
+        reverted_history_id,
+        batch_id
+    ) VALUES (
+        COALESCE(NEW.id, OLD.id),
+        history_action,
+        actor,
+        old_json,
+        new_json,
+        changes,
+        NULLIF(current_setting('app.reverted_history_id', true), '')::INTEGER,
+        NULLIF(current_setting('app.batch_id', true), '')::UUID
+    );
+    
+    RETURN COALESCE(NEW, OLD);
+END;
+$$ LANGUAGE plpgsql;
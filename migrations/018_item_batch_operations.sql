@@ -0,0 +1,10 @@
+-- Пакетные операции с товарами и откат пакетов целиком
+ALTER TABLE item_batches DROP CONSTRAINT IF EXISTS item_batches_kind_check;
+ALTER TABLE item_batches ADD CONSTRAINT item_batches_kind_check
+    CHECK (kind IN ('IMPORT', 'BATCH', 'REVERT'));
+
+ALTER TABLE item_batches ADD COLUMN IF NOT EXISTS deleted_count INTEGER NOT NULL DEFAULT 0;
+
+-- Для REVERT - отмененный пакет; пакет можно откатить только один раз
+ALTER TABLE item_batches ADD COLUMN IF NOT EXISTS reverted_batch_id UUID REFERENCES item_batches(id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_item_batches_reverted ON item_batches(reverted_batch_id);
@@ -0,0 +1,11 @@
+-- Полнотекстовый поиск по товарам. Индекс по выражению, а не колонка
+-- tsvector: снимки истории и откат берут все колонки items как есть.
+-- Конфигурация simple - названия бывают и на русском, и на английском.
+CREATE INDEX IF NOT EXISTS idx_items_search ON items
+    USING GIN (to_tsvector('simple', COALESCE(name, '') || ' ' || COALESCE(description, '')));
+
+-- Фильтры и сортировки списка товаров
+CREATE INDEX IF NOT EXISTS idx_items_created_by ON items(created_by);
+CREATE INDEX IF NOT EXISTS idx_items_quantity ON items(quantity);
+CREATE INDEX IF NOT EXISTS idx_items_price ON items(price);
+CREATE INDEX IF NOT EXISTS idx_items_updated_at ON items(updated_at);
@@ -0,0 +1,94 @@
+-- Номер версии товара для оптимистичной блокировки: растет при каждой записи,
+-- клиент передает ожидаемую версию при изменении и удалении
+ALTER TABLE items ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+
+-- Версия товара после записи истории (для DELETE - удаленная версия).
+-- У записей, сделанных до появления версий, она пуста.
+ALTER TABLE item_history ADD COLUMN IF NOT EXISTS version INTEGER;
+CREATE INDEX IF NOT EXISTS idx_item_history_item_version ON item_history(item_id, version);
+
+-- Версию ведет база, а не приложение: значение из запроса или из снимка
+-- при откате игнорируется. Восстановленный после удаления товар продолжает
+-- нумерацию своей истории.
+CREATE OR REPLACE FUNCTION set_item_version()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        NEW.version := COALESCE((SELECT MAX(version) FROM item_history WHERE item_id = NEW.id), 0) + 1;
+    ELSE
+        NEW.version := OLD.version + 1;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS set_items_version ON items;
+CREATE TRIGGER set_items_version
+BEFORE INSERT OR UPDATE ON items
+FOR EACH ROW
+EXECUTE FUNCTION set_item_version();
+
+-- Версия записывается в историю вместе со снимком
+CREATE OR REPLACE FUNCTION log_item_changes()
+RETURNS TRIGGER AS $$
+DECLARE
+    changes JSONB;
+    old_json JSONB;
+    new_json JSONB;
+    actor VARCHAR(50);
+    history_action VARCHAR(20);
+BEGIN
+    old_json := CASE WHEN TG_OP = 'INSERT' THEN NULL ELSE to_jsonb(OLD) END;
+    new_json := CASE WHEN TG_OP = 'DELETE' THEN NULL ELSE to_jsonb(NEW) END;
+
+    -- Изменения считаются по всем колонкам снимков в виде пар old/new,
+    -- одинаково для создания, изменения и удаления. updated_at и version
+    -- меняются при любом изменении и в changes не попадают.
+    SELECT COALESCE(jsonb_object_agg(k.key, jsonb_build_object(
+               'old', COALESCE(old_json, '{}'::JSONB) -> k.key,
+               'new', COALESCE(new_json, '{}'::JSONB) -> k.key)), '{}'::JSONB)
+    INTO changes
+    FROM jsonb_object_keys(COALESCE(old_json, '{}'::JSONB) || COALESCE(new_json, '{}'::JSONB)) AS k(key)
+    WHERE k.key NOT IN ('updated_at', 'version')
+      AND (COALESCE(old_json, '{}'::JSONB) -> k.key) IS DISTINCT FROM (COALESCE(new_json, '{}'::JSONB) -> k.key);
+
+    -- Изменение вне приложения (без app.current_user) остается без автора,
+    -- кроме создания, где автор известен из created_by
+    actor := NULLIF(current_setting('app.current_user', true), '');
+    IF actor IS NULL AND TG_OP = 'INSERT' THEN
+        actor := NEW.created_by;
+    END IF;
+    
+    -- Откат помечается приложением: запись получает действие REVERT
+    -- и ссылку на отмененную запись истории
+    history_action := CASE TG_OP WHEN 'INSERT' THEN 'CREATE' ELSE TG_OP END;
+    IF current_setting('app.history_action', true) = 'REVERT' THEN
+        history_action := 'REVERT';
+    END IF;
+    
+    -- Вставляем запись в историю
+    INSERT INTO item_history (
+        item_id,
+        action,
+        changed_by,
+        old_data,
+        new_data,
+        changes,
+        reverted_history_id,
+        batch_id,
+        version
+    ) VALUES (
+        COALESCE(NEW.id, OLD.id),
+        history_action,
+        actor,
+        old_json,
+        new_json,
+        changes,
+        NULLIF(current_setting('app.reverted_history_id', true), '')::INTEGER,
+        NULLIF(current_setting('app.batch_id', true), '')::UUID,
+        COALESCE(NEW.version, OLD.version)
+    );
+    
+    RETURN COALESCE(NEW, OLD);
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,39 @@
+-- Журнал движений остатков: количество меняется приращением, а не
+-- перезаписью, и каждое движение ссылается на свою запись истории
+CREATE TABLE IF NOT EXISTS stock_movements (
+    id SERIAL PRIMARY KEY,
+    -- Без внешнего ключа, как в item_history: журнал переживает удаление товара
+    item_id INTEGER NOT NULL,
+    movement_type VARCHAR(20) NOT NULL CHECK (movement_type IN ('RECEIPT', 'PICK', 'ADJUSTMENT', 'WRITE_OFF')),
+    quantity_delta INTEGER NOT NULL CHECK (quantity_delta <> 0),
+    quantity_before INTEGER NOT NULL,
+    quantity_after INTEGER NOT NULL CHECK (quantity_after >= 0),
+    reason_code VARCHAR(50) NOT NULL,
+    -- Документ-основание: накладная, заказ, акт списания
+    reference VARCHAR(100),
+    note TEXT,
+    history_id INTEGER REFERENCES item_history(id),
+    created_by VARCHAR(50) REFERENCES users(username),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    -- Знак приращения задан типом движения; корректировка - в любую сторону
+    CHECK (
+        (movement_type = 'RECEIPT' AND quantity_delta > 0) OR
+        (movement_type IN ('PICK', 'WRITE_OFF') AND quantity_delta < 0) OR
+        movement_type = 'ADJUSTMENT'
+    ),
+    CHECK (quantity_after = quantity_before + quantity_delta)
+);
+
+CREATE INDEX IF NOT EXISTS idx_stock_movements_item ON stock_movements(item_id, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_stock_movements_reference ON stock_movements(reference);
+CREATE INDEX IF NOT EXISTS idx_stock_movements_history ON stock_movements(history_id);
+
+-- Движения выделены в отдельное право: кладовщику не нужно править товар целиком
+INSERT INTO permissions (name, description) VALUES
+    ('move_stock', 'Record stock movements (receipts, picks, adjustments, write-offs)')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'move_stock'),
+    ('manager', 'move_stock')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,50 @@
+-- Изменения по полям считает только приложение (пакет internal/diff) по
+-- снимкам old_data/new_data. Триггер больше не вычисляет changes: его
+-- сравнение расходилось с приложением в игнорируемых полях, а у записей
+-- создания до миграции 016 в changes попадали все колонки.
+CREATE OR REPLACE FUNCTION log_item_changes()
+RETURNS TRIGGER AS $$
+DECLARE
+    actor VARCHAR(50);
+    history_action VARCHAR(20);
+BEGIN
+    -- Изменение вне приложения (без app.current_user) остается без автора,
+    -- кроме создания, где автор известен из created_by
+    actor := NULLIF(current_setting('app.current_user', true), '');
+    IF actor IS NULL AND TG_OP = 'INSERT' THEN
+        actor := NEW.created_by;
+    END IF;
+    
+    -- Откат помечается приложением: запись получает действие REVERT
+    -- и ссылку на отмененную запись истории
+    history_action := CASE TG_OP WHEN 'INSERT' THEN 'CREATE' ELSE TG_OP END;
+    IF current_setting('app.history_action', true) = 'REVERT' THEN
+        history_action := 'REVERT';
+    END IF;
+    
+    -- Вставляем запись в историю
+    INSERT INTO item_history (
+        item_id,
+        action,
+        changed_by,
+        old_data,
+        new_data,
+        reverted_history_id,
+        batch_id,
+        version
+    ) VALUES (
+        COALESCE(NEW.id, OLD.id),
+        history_action,
+        actor,
+        CASE WHEN TG_OP = 'INSERT' THEN NULL ELSE to_jsonb(OLD) END,
+        CASE WHEN TG_OP = 'DELETE' THEN NULL ELSE to_jsonb(NEW) END,
+        NULLIF(current_setting('app.reverted_history_id', true), '')::INTEGER,
+        NULLIF(current_setting('app.batch_id', true), '')::UUID,
+        COALESCE(NEW.version, OLD.version)
+    );
+    
+    RETURN COALESCE(NEW, OLD);
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE item_history DROP COLUMN changes;